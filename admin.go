@@ -0,0 +1,398 @@
+package progszy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AdminHandler returns an HTTP handler for the admin REST API,
+// for managing the given cache. All responses are JSON, except diffs.
+// All routes except /namespaces take an optional ?namespace={name}
+// query param, to manage the named namespace instead.
+//
+//	GET    /namespaces                  List namespaces.
+//	GET    /bins                        List bins.
+//	GET    /bins/{bin}/records          List records in a bin (?offset=0&limit=100).
+//	GET    /records?url={url}           Inspect the record for a URL.
+//	DELETE /records?url={url}           Delete the record for a URL.
+//	GET    /versions?url={url}          List the versions of a URL, newest first.
+//	GET    /versions/diff?url={url}     Diff two versions of a URL (&from={created}&to={created}).
+//	POST   /domains/{domain}/rotate     Start a new bin for a base domain.
+//	GET    /stats                       Cache statistics.
+func AdminHandler(cache Cache) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /namespaces", func(w http.ResponseWriter, r *http.Request) {
+		names, err := cache.Namespaces()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if names == nil {
+			names = []string{}
+		}
+		writeJSON(w, http.StatusOK, names)
+	})
+
+	mux.HandleFunc("GET /bins", func(w http.ResponseWriter, r *http.Request) {
+		cache, ok := namespace(w, r, cache)
+		if !ok {
+			return
+		}
+		bins, err := cache.Bins()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if bins == nil {
+			bins = []BinInfo{}
+		}
+		writeJSON(w, http.StatusOK, bins)
+	})
+
+	mux.HandleFunc("GET /bins/{bin}/records", func(w http.ResponseWriter, r *http.Request) {
+		cache, ok := namespace(w, r, cache)
+		if !ok {
+			return
+		}
+		offset, err := queryInt(r, "offset", 0)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorInfo{err.Error()})
+			return
+		}
+		limit, err := queryInt(r, "limit", 100)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorInfo{err.Error()})
+			return
+		}
+		records := []*recordInfo{}
+		i := 0
+		errDone := errors.New("done")
+		err = cache.Walk(r.PathValue("bin"), func(cr *CacheRecord) error {
+			if i >= offset+limit {
+				return errDone
+			}
+			if i >= offset {
+				records = append(records, newRecordInfo(cr))
+			}
+			i++
+			return nil
+		})
+		if err != nil && err != errDone {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, records)
+	})
+
+	mux.HandleFunc("GET /records", func(w http.ResponseWriter, r *http.Request) {
+		cache, ok := namespace(w, r, cache)
+		if !ok {
+			return
+		}
+		uri, ok := queryURL(w, r)
+		if !ok {
+			return
+		}
+		cr, err := cache.Peek(uri)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newRecordInfo(cr))
+	})
+
+	mux.HandleFunc("DELETE /records", func(w http.ResponseWriter, r *http.Request) {
+		cache, ok := namespace(w, r, cache)
+		if !ok {
+			return
+		}
+		uri, ok := queryURL(w, r)
+		if !ok {
+			return
+		}
+		err := cache.Delete(uri)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		log.Printf("Deleted %s", uri)
+		writeJSON(w, http.StatusOK, struct {
+			Deleted string `json:"deleted"`
+		}{uri})
+	})
+
+	mux.HandleFunc("GET /versions", func(w http.ResponseWriter, r *http.Request) {
+		cache, ok := namespace(w, r, cache)
+		if !ok {
+			return
+		}
+		uri, ok := queryURL(w, r)
+		if !ok {
+			return
+		}
+		versions, err := cache.Versions(uri)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		records := []*recordInfo{}
+		for _, cr := range versions {
+			records = append(records, newRecordInfo(cr))
+		}
+		writeJSON(w, http.StatusOK, records)
+	})
+
+	mux.HandleFunc("GET /versions/diff", func(w http.ResponseWriter, r *http.Request) {
+		cache, ok := namespace(w, r, cache)
+		if !ok {
+			return
+		}
+		uri, ok := queryURL(w, r)
+		if !ok {
+			return
+		}
+		versions, err := cache.Versions(uri)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		// By default, diff the previous version with the newest.
+		from, err := findVersion(versions, r.URL.Query().Get("from"), 1)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		to, err := findVersion(versions, r.URL.Query().Get("to"), 0)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		a, err := versionBody(from)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		b, err := versionBody(to)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		name := func(cr *CacheRecord) string {
+			return cr.URL + "\t" + cr.Created.UTC().Format(time.RFC3339Nano)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, unifiedDiff(name(from), name(to), a, b))
+	})
+
+	mux.HandleFunc("POST /domains/{domain}/rotate", func(w http.ResponseWriter, r *http.Request) {
+		cache, ok := namespace(w, r, cache)
+		if !ok {
+			return
+		}
+		bd := r.PathValue("domain")
+		if !validBinKey(bd) {
+			writeError(w, ErrInvalidBinKey)
+			return
+		}
+		// Only existing bins can be rotated.
+		bins, err := cache.Bins()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		found := false
+		for _, b := range bins {
+			if b.BaseDomain == bd {
+				found = true
+				break
+			}
+		}
+		if !found {
+			writeError(w, ErrNoSuchBin)
+			return
+		}
+		err = cache.Rotate(bd)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Rotated string `json:"rotated"`
+		}{bd})
+	})
+
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		cache, ok := namespace(w, r, cache)
+		if !ok {
+			return
+		}
+		stats, err := cache.Stats()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, stats)
+	})
+
+	return mux
+}
+
+// recordInfo is the JSON form of a CacheRecord, without its body.
+type recordInfo struct {
+	URL              string    `json:"url"`
+	Key              string    `json:"key"`
+	BaseDomain       string    `json:"base_domain"`
+	Status           int       `json:"status"`
+	Protocol         string    `json:"protocol"`
+	ContentLanguage  string    `json:"content_language,omitempty"`
+	ContentType      string    `json:"content_type,omitempty"`
+	ETag             string    `json:"etag,omitempty"`
+	LastModified     string    `json:"last_modified,omitempty"`
+	Location         string    `json:"location,omitempty"`
+	ContentLength    int64     `json:"content_length"`
+	CompressedLength int64     `json:"compressed_length"`
+	ResponseTime     float64   `json:"response_ms"`
+	MD5              string    `json:"md5"`
+	Created          time.Time `json:"created"`
+	LastAccessed     time.Time `json:"last_accessed"`
+	HitCount         int64     `json:"hit_count"`
+}
+
+func newRecordInfo(cr *CacheRecord) *recordInfo {
+	return &recordInfo{
+		URL:              cr.URL,
+		Key:              cr.Key,
+		BaseDomain:       cr.BaseDomain,
+		Status:           cr.Status,
+		Protocol:         cr.Protocol,
+		ContentLanguage:  cr.ContentLanguage,
+		ContentType:      cr.ContentType,
+		ETag:             cr.ETag,
+		LastModified:     cr.LastModified,
+		Location:         cr.Location,
+		ContentLength:    cr.ContentLength,
+		CompressedLength: cr.CompressedLength,
+		ResponseTime:     cr.ResponseTime,
+		MD5:              cr.MD5,
+		Created:          cr.Created,
+		LastAccessed:     cr.LastAccessed,
+		HitCount:         cr.HitCount,
+	}
+}
+
+type errorInfo struct {
+	Error string `json:"error"`
+}
+
+// writeError writes the given error, with an appropriate status code.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if err == ErrCacheMiss || err == ErrNoSuchBin || err == errNoSuchVersion {
+		status = http.StatusNotFound
+	} else if err == errVersionTooLarge {
+		status = http.StatusRequestEntityTooLarge
+	} else if err == ErrInvalidNamespace || err == ErrInvalidBinKey || err == errInvalidVersion {
+		status = http.StatusBadRequest
+	} else {
+		log.Printf("Admin error: %v\n", err)
+	}
+	writeJSON(w, status, errorInfo{err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		log.Printf("Admin JSON encoding error: %v\n", err)
+	}
+}
+
+// namespace returns the cache for the namespace query param, if any,
+// writing an error if it is invalid.
+func namespace(w http.ResponseWriter, r *http.Request, cache Cache) (Cache, bool) {
+	ns, err := cache.Namespace(r.URL.Query().Get("namespace"))
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+	return ns, true
+}
+
+// maxDiffSize is the largest body that can be diffed.
+const maxDiffSize = 10 * 1024 * 1024 // 10mb
+
+// errNoSuchVersion occurs when a requested version does not exist.
+var errNoSuchVersion = errors.New("no such version")
+
+// errInvalidVersion occurs when a requested version time is not valid.
+var errInvalidVersion = errors.New("invalid version time")
+
+// errVersionTooLarge occurs when a version is larger than maxDiffSize.
+var errVersionTooLarge = errors.New("version too large to diff (over " + byteCountDecimal(maxDiffSize) + ")")
+
+// findVersion returns the version with the given created time, if any,
+// otherwise the version at index def (where 0 is the newest).
+func findVersion(versions []*CacheRecord, created string, def int) (*CacheRecord, error) {
+	if len(created) == 0 {
+		if def >= len(versions) {
+			return nil, errNoSuchVersion
+		}
+		return versions[def], nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, created)
+	if err != nil {
+		return nil, errInvalidVersion
+	}
+	for _, cr := range versions {
+		if cr.Created.Equal(t) {
+			return cr, nil
+		}
+	}
+	return nil, errNoSuchVersion
+}
+
+// versionBody returns the uncompressed body of the given version, as text.
+func versionBody(cr *CacheRecord) (string, error) {
+	if cr.ContentLength > maxDiffSize {
+		return "", errVersionTooLarge
+	}
+	rc, err := cr.Body()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	return string(b), err
+}
+
+// queryURL returns the url query param, writing an error if it is absent.
+func queryURL(w http.ResponseWriter, r *http.Request) (string, bool) {
+	uri := r.URL.Query().Get("url")
+	if len(uri) == 0 {
+		writeJSON(w, http.StatusBadRequest, errorInfo{"missing url param"})
+		return "", false
+	}
+	return uri, true
+}
+
+// queryInt returns the named non-negative integer query param, or def if absent.
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if len(v) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid " + name + " value: " + v)
+	}
+	return n, nil
+}
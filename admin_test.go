@@ -0,0 +1,285 @@
+package progszy_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jimsmart/progszy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Admin API", func() {
+
+	var cache *progszy.SqliteCache
+	var server *httptest.Server
+
+	put := func(uri, content string) {
+		cr, err := progszy.NewCacheRecord(uri, 200, "HTTP/1.1", "", "text/plain", "", "", []byte(content), 0, time.Now())
+		Expect(err).To(BeNil())
+		err = cache.Put(cr)
+		Expect(err).To(BeNil())
+	}
+
+	call := func(method, path string, v interface{}) int {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		Expect(err).To(BeNil())
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+		if v != nil {
+			err = json.NewDecoder(resp.Body).Decode(v)
+			Expect(err).To(BeNil())
+		}
+		return resp.StatusCode
+	}
+
+	BeforeEach(func() {
+		cache = progszy.NewSqliteCache(testCachePath)
+
+		// Make an old bin for example.com.
+		put("http://example.com/old", "old-content")
+		err := cache.CloseAll()
+		Expect(err).To(BeNil())
+		matches, err := filepath.Glob(filepath.Join(testCachePath, "example.com-*.sqlite"))
+		Expect(err).To(BeNil())
+		Expect(matches).To(HaveLen(1))
+		err = os.Rename(matches[0], filepath.Join(testCachePath, "example.com-2020-01-01-0000.sqlite"))
+		Expect(err).To(BeNil())
+		cache = progszy.NewSqliteCache(testCachePath)
+		err = cache.Rotate("example.com")
+		Expect(err).To(BeNil())
+
+		put("http://example.com/a", "content-a")
+		put("http://example.com/b", "content-b")
+		put("http://example.com.au/", "content-au")
+
+		server = httptest.NewServer(progszy.AdminHandler(cache))
+	})
+
+	AfterEach(func() {
+		server.Close()
+		err := cache.CloseAll()
+		Expect(err).To(BeNil())
+		err = deleteSqliteDBs()
+		Expect(err).To(BeNil())
+	})
+
+	It("should list bins", func() {
+		var bins []progszy.BinInfo
+		status := call(http.MethodGet, "/bins", &bins)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(bins).To(HaveLen(3))
+		Expect(bins[0].Name).To(Equal("example.com-2020-01-01-0000.sqlite"))
+		Expect(bins[0].BaseDomain).To(Equal("example.com"))
+		Expect(bins[0].Current).To(BeFalse())
+		Expect(bins[1].BaseDomain).To(Equal("example.com"))
+		Expect(bins[1].Current).To(BeTrue())
+		Expect(bins[2].BaseDomain).To(Equal("example.com.au"))
+		Expect(bins[2].Current).To(BeTrue())
+		Expect(bins[2].Size).To(BeNumerically(">", 0))
+	})
+
+	It("should list records in a bin", func() {
+		var bins []progszy.BinInfo
+		call(http.MethodGet, "/bins", &bins)
+
+		var records []map[string]interface{}
+		status := call(http.MethodGet, "/bins/"+bins[1].Name+"/records", &records)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(records).To(HaveLen(2))
+		Expect(records[0]["url"]).To(Equal("http://example.com/a"))
+		Expect(records[1]["url"]).To(Equal("http://example.com/b"))
+
+		status = call(http.MethodGet, "/bins/"+bins[1].Name+"/records?offset=1&limit=5", &records)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(records).To(HaveLen(1))
+		Expect(records[0]["url"]).To(Equal("http://example.com/b"))
+
+		status = call(http.MethodGet, "/bins/"+bins[0].Name+"/records", &records)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(records).To(HaveLen(1))
+		Expect(records[0]["url"]).To(Equal("http://example.com/old"))
+
+		status = call(http.MethodGet, "/bins/nope.sqlite/records", nil)
+		Expect(status).To(Equal(http.StatusNotFound))
+	})
+
+	It("should inspect and delete a record", func() {
+		q := "?url=" + url.QueryEscape("http://example.com/a")
+		var record map[string]interface{}
+		status := call(http.MethodGet, "/records"+q, &record)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(record["content_length"]).To(BeNumerically("==", len("content-a")))
+		Expect(record["content_type"]).To(Equal("text/plain"))
+
+		// Inspecting a record doesn't count as a hit.
+		status = call(http.MethodGet, "/records"+q, &record)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(record["hit_count"]).To(BeNumerically("==", 0))
+		cr, err := cache.Peek("http://example.com/a")
+		Expect(err).To(BeNil())
+		Expect(cr.HitCount).To(BeNumerically("==", 0))
+		Expect(cr.LastAccessed.IsZero()).To(BeTrue())
+
+		status = call(http.MethodDelete, "/records"+q, nil)
+		Expect(status).To(Equal(http.StatusOK))
+		_, err = cache.Get("http://example.com/a")
+		Expect(err).To(Equal(progszy.ErrCacheMiss))
+
+		status = call(http.MethodGet, "/records"+q, nil)
+		Expect(status).To(Equal(http.StatusNotFound))
+		status = call(http.MethodDelete, "/records"+q, nil)
+		Expect(status).To(Equal(http.StatusNotFound))
+		status = call(http.MethodDelete, "/records", nil)
+		Expect(status).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should rotate a domain's bin", func() {
+		status := call(http.MethodPost, "/domains/example.com.au/rotate", nil)
+		Expect(status).To(Equal(http.StatusOK))
+		bins, err := cache.Bins()
+		Expect(err).To(BeNil())
+		last := bins[len(bins)-1]
+		Expect(last.BaseDomain).To(Equal("example.com.au"))
+		Expect(last.Current).To(BeTrue())
+	})
+
+	It("should reject rotating unknown or unsafe bin keys", func() {
+		status := call(http.MethodPost, "/domains/..%2Fescaped/rotate", nil)
+		Expect(status).To(Equal(http.StatusBadRequest))
+		status = call(http.MethodPost, "/domains/a%5Cb/rotate", nil)
+		Expect(status).To(Equal(http.StatusBadRequest))
+		status = call(http.MethodPost, "/domains/unknown.example.org/rotate", nil)
+		Expect(status).To(Equal(http.StatusNotFound))
+		_, err := os.Stat(filepath.Join(filepath.Dir(testCachePath), "escaped"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		matches, err := filepath.Glob(filepath.Join(filepath.Dir(testCachePath), "escaped-*"))
+		Expect(err).To(BeNil())
+		Expect(matches).To(BeEmpty())
+		bins, err := cache.Bins()
+		Expect(err).To(BeNil())
+		for _, b := range bins {
+			Expect(b.BaseDomain).ToNot(Equal("unknown.example.org"))
+		}
+
+		err = cache.Rotate("../escaped")
+		Expect(err).To(Equal(progszy.ErrInvalidBinKey))
+	})
+
+	It("should list namespaces, and manage their bins", func() {
+		defer os.RemoveAll(filepath.Join(testCachePath, "alpha"))
+		ns, err := cache.Namespace("alpha")
+		Expect(err).To(BeNil())
+		cr, err := progszy.NewCacheRecord("http://example.org/", 200, "HTTP/1.1", "", "text/plain", "", "", []byte("content-org"), 0, time.Now())
+		Expect(err).To(BeNil())
+		err = ns.Put(cr)
+		Expect(err).To(BeNil())
+
+		var names []string
+		status := call(http.MethodGet, "/namespaces", &names)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(names).To(Equal([]string{"alpha"}))
+
+		var bins []progszy.BinInfo
+		status = call(http.MethodGet, "/bins?namespace=alpha", &bins)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(bins).To(HaveLen(1))
+		Expect(bins[0].BaseDomain).To(Equal("example.org"))
+
+		status = call(http.MethodGet, "/bins?namespace=..", nil)
+		Expect(status).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should list and diff versions of a URL", func() {
+		t1 := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+		t2 := t1.Add(time.Hour)
+		cr, err := progszy.NewCacheRecord("http://example.com/page", 200, "HTTP/1.1", "", "text/plain", "", "", []byte("line1\nline2\nline3\n"), 0, t1)
+		Expect(err).To(BeNil())
+		err = cache.Put(cr)
+		Expect(err).To(BeNil())
+		cr, err = progszy.NewCacheRecord("http://example.com/page", 200, "HTTP/1.1", "", "text/plain", "", "", []byte("line1\nline2 changed\nline3\nline4\n"), 0, t2)
+		Expect(err).To(BeNil())
+		err = cache.Replace(cr, true)
+		Expect(err).To(BeNil())
+		// Other variants are versioned apart.
+		cr, err = progszy.NewCacheRecord("http://example.com/page", 200, "HTTP/1.1", "fr", "text/plain", "", "", []byte("ligne1\n"), 0, t1.Add(30*time.Minute))
+		Expect(err).To(BeNil())
+		err = cache.Put(cr)
+		Expect(err).To(BeNil())
+
+		q := "?url=" + url.QueryEscape("http://example.com/page")
+		var records []map[string]interface{}
+		status := call(http.MethodGet, "/versions"+q, &records)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(records).To(HaveLen(2))
+		Expect(records[0]["created"]).To(Equal(t2.Format(time.RFC3339Nano)))
+		Expect(records[1]["created"]).To(Equal(t1.Format(time.RFC3339Nano)))
+
+		diff := func(params string) (int, string) {
+			resp, err := http.Get(server.URL + "/versions/diff" + q + params)
+			Expect(err).To(BeNil())
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			Expect(err).To(BeNil())
+			return resp.StatusCode, string(b)
+		}
+		status, body := diff("")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("--- http://example.com/page\t" + t1.Format(time.RFC3339Nano) + "\n" +
+			"+++ http://example.com/page\t" + t2.Format(time.RFC3339Nano) + "\n" +
+			"@@ -1,3 +1,4 @@\n" +
+			" line1\n" +
+			"-line2\n" +
+			"+line2 changed\n" +
+			" line3\n" +
+			"+line4\n"))
+
+		from := "&from=" + url.QueryEscape(t2.Format(time.RFC3339Nano))
+		to := "&to=" + url.QueryEscape(t1.Format(time.RFC3339Nano))
+		status, body = diff(from + to)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(ContainSubstring("+line2\n"))
+		status, body = diff(from + "&to=" + url.QueryEscape(t2.Format(time.RFC3339Nano)))
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(BeEmpty())
+
+		status, _ = diff("&from=2019-01-01T00:00:00Z")
+		Expect(status).To(Equal(http.StatusNotFound))
+		status, _ = diff("&from=yesterday")
+		Expect(status).To(Equal(http.StatusBadRequest))
+
+		big := []byte(strings.Repeat("big\n", 3*1024*1024))
+		for _, created := range []time.Time{t1, t2} {
+			cr, err = progszy.NewCacheRecord("http://example.com/big", 200, "HTTP/1.1", "", "text/plain", "", "", big, 0, created)
+			Expect(err).To(BeNil())
+			err = cache.Replace(cr, true)
+			Expect(err).To(BeNil())
+		}
+		q = "?url=" + url.QueryEscape("http://example.com/big")
+		status, _ = diff("")
+		Expect(status).To(Equal(http.StatusRequestEntityTooLarge))
+	})
+
+	It("should report statistics", func() {
+		var stats progszy.CacheStats
+		status := call(http.MethodGet, "/stats", &stats)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(stats.Bins).To(Equal(3))
+		Expect(stats.Size).To(BeNumerically(">", 0))
+		Expect(stats.Domains).To(HaveLen(2))
+		Expect(stats.Domains["example.com"].Records).To(BeNumerically("==", 2))
+		Expect(stats.Domains["example.com"].ContentLength).To(BeNumerically("==", len("content-a")+len("content-b")))
+		Expect(stats.Domains["example.com.au"].Records).To(BeNumerically("==", 1))
+	})
+
+})
@@ -0,0 +1,144 @@
+package progszy
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Binner decides which bin (database) the cached responses
+// for a URL are stored in.
+type Binner interface {
+	// Bin returns the name of the bin for the given URL.
+	Bin(u *url.URL) (string, error)
+}
+
+// BinnerFunc adapts an ordinary function to a Binner.
+type BinnerFunc func(u *url.URL) (string, error)
+
+// Bin calls f(u).
+func (f BinnerFunc) Bin(u *url.URL) (string, error) {
+	return f(u)
+}
+
+// RootDomainBinner bins URLs by their base domain,
+// so api.example.com and www.example.com share a bin.
+// This is the default.
+var RootDomainBinner Binner = BinnerFunc(BaseDomainName)
+
+// FQDNBinner bins URLs by their fully qualified host name,
+// ignoring any port number.
+var FQDNBinner Binner = BinnerFunc(func(u *url.URL) (string, error) {
+	h := u.Hostname()
+	if len(h) == 0 {
+		return "", fmt.Errorf("no host in URL %s", u)
+	}
+	return strings.ToLower(h), nil
+})
+
+// HostPortBinner bins URLs by their host name and port number,
+// if the URL has one, e.g. localhost_8080.
+var HostPortBinner Binner = BinnerFunc(func(u *url.URL) (string, error) {
+	h, err := FQDNBinner.Bin(u)
+	if err != nil {
+		return "", err
+	}
+	if p := u.Port(); len(p) > 0 {
+		// Colons are not allowed in Windows filenames.
+		h += "_" + p
+	}
+	return h, nil
+})
+
+// BinRule maps URLs matching a regular expression to a bin.
+type BinRule struct {
+	// Match is a regular expression, matched against the normalised URL.
+	Match string `json:"match"`
+	// Bin is the name of the bin, which may refer to
+	// submatches of Match, e.g. "$1".
+	Bin string `json:"bin"`
+}
+
+// RegexBinner bins URLs using a list of rules. The first matching
+// rule wins, URLs not matching any rule are binned by the fallback.
+type RegexBinner struct {
+	rules    []BinRule
+	res      []*regexp.Regexp
+	fallback Binner
+}
+
+// NewRegexBinner returns a new RegexBinner for the given rules.
+// If fallback is nil, RootDomainBinner is used.
+func NewRegexBinner(rules []BinRule, fallback Binner) (*RegexBinner, error) {
+	if fallback == nil {
+		fallback = RootDomainBinner
+	}
+	b := &RegexBinner{
+		rules:    rules,
+		res:      make([]*regexp.Regexp, len(rules)),
+		fallback: fallback,
+	}
+	for i, r := range rules {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("bin rule %q: %v", r.Match, err)
+		}
+		if len(r.Bin) == 0 {
+			return nil, fmt.Errorf("bin rule %q: missing bin", r.Match)
+		}
+		b.res[i] = re
+	}
+	return b, nil
+}
+
+// Bin returns the bin of the first rule matching the given URL.
+func (b *RegexBinner) Bin(u *url.URL) (string, error) {
+	s := u.String()
+	for i, re := range b.res {
+		m := re.FindStringSubmatchIndex(s)
+		if m == nil {
+			continue
+		}
+		bin := string(re.ExpandString(nil, b.rules[i].Bin, s, m))
+		if len(bin) == 0 {
+			return "", fmt.Errorf("bin rule %q: empty bin for URL %s", b.rules[i].Match, s)
+		}
+		return bin, nil
+	}
+	return b.fallback.Bin(u)
+}
+
+// NewBinner returns the Binner for the named strategy:
+// "root" (or empty), "fqdn", "host-port" or "regex".
+// The rules are only used by "regex", whose fallback is "root".
+func NewBinner(strategy string, rules []BinRule) (Binner, error) {
+	switch strategy {
+	case "", "root":
+		return RootDomainBinner, nil
+	case "fqdn":
+		return FQDNBinner, nil
+	case "host-port":
+		return HostPortBinner, nil
+	case "regex":
+		if len(rules) == 0 {
+			return nil, errors.New("regex binning requires bin rules")
+		}
+		return NewRegexBinner(rules, nil)
+	}
+	return nil, fmt.Errorf("unknown binning strategy %q", strategy)
+}
+
+// safeBinName replaces any characters that are unsafe
+// in a bin's filename with underscores.
+func safeBinName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
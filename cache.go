@@ -3,13 +3,17 @@ package progszy
 import (
 	"bytes"
 	"crypto/md5"
+	"database/sql"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,9 +23,92 @@ import (
 
 type Cache interface {
 	Get(uri string) (*CacheRecord, error)
+	// Peek gets the record for the given URL, like Get, but
+	// without tracking the access (for hit counts and LRU eviction).
+	Peek(uri string) (*CacheRecord, error)
+	// GetAsOf gets the record for the given URL as it was cached
+	// at the given time, from the newest bin created by then.
+	GetAsOf(uri string, asOf time.Time) (*CacheRecord, error)
+	// GetPrevious gets the newest record for the given URL that is no longer
+	// current, such as from a bin that was rotated out.
+	GetPrevious(uri string) (*CacheRecord, error)
 	Put(cr *CacheRecord) error
 	CloseAll() error
 	Flush(uri string) error
+	// Refresh updates the stored timestamp (and validators) of the given
+	// record, after upstream confirmed it is unchanged.
+	Refresh(cr *CacheRecord) error
+	// Replace stores the given record, replacing any existing record for its URL,
+	// which is kept as a previous version if requested (see Versions).
+	Replace(cr *CacheRecord, keep bool) error
+	// Versions returns the versions of the given URL in its current bin,
+	// newest first, of the same variant as its current record.
+	Versions(uri string) ([]*CacheRecord, error)
+	// Delete removes the given URL from the cache.
+	Delete(uri string) error
+	// DeleteMatching removes all URLs in the given URL's current bin
+	// whose normalised URL (key) matches, returning how many were removed.
+	DeleteMatching(uri string, match func(key string) bool) (int, error)
+	// Expire removes records created before the given time from the
+	// base domain's current bin, archiving them into the bin's history
+	// if requested, and returns how many were removed.
+	Expire(bd string, before time.Time, archive bool) (int, error)
+	// Trim evicts the least recently used records, history and old bins,
+	// until each base domain is within its quota, and all (including any
+	// namespaces) are within the total quota, returning how many records
+	// were evicted. Quotas are in compressed bytes, zero is unlimited.
+	Trim(quota func(bd string) int64, totalQuota int64) (int, error)
+	// Rotate starts a new bin for the given base domain.
+	Rotate(bd string) error
+	// Bins lists the cache's bins.
+	Bins() ([]BinInfo, error)
+	// Walk calls fn for each record in the named bin, in URL order.
+	// The records' bodies are only read on demand, during fn.
+	Walk(bin string, fn func(cr *CacheRecord) error) error
+	// Stats returns statistics for the cache's current bins.
+	Stats() (*CacheStats, error)
+	// Namespace returns the cache for the named namespace, which is
+	// kept apart from all others. An empty name returns this cache.
+	Namespace(name string) (Cache, error)
+	// Namespaces lists the cache's namespaces.
+	Namespaces() ([]string, error)
+}
+
+// BinInfo describes a cache bin, a database holding
+// the cached responses for a base domain (or whichever
+// grouping of URLs the cache's Binner decides).
+type BinInfo struct {
+	// Name of the bin's file.
+	Name string `json:"name"`
+	// BaseDomain is the bin's key, as given by the cache's Binner:
+	// by default, the base domain of the bin's records.
+	BaseDomain string `json:"base_domain"`
+	// Created is the time the bin was created.
+	Created time.Time `json:"created"`
+	// Size of the bin, in bytes.
+	Size int64 `json:"size"`
+	// Current is true for the bin that new records are added to.
+	Current bool `json:"current"`
+}
+
+// CacheStats holds statistics for a cache.
+type CacheStats struct {
+	// Bins is the total number of bins, including old bins.
+	Bins int `json:"bins"`
+	// Size is the total size of all bins, in bytes.
+	Size int64 `json:"size"`
+	// Domains holds the statistics of the current bin for each base domain.
+	Domains map[string]*DomainStats `json:"domains"`
+}
+
+// DomainStats holds statistics for the current bin of a base domain.
+type DomainStats struct {
+	// Records is the number of cached responses.
+	Records int64 `json:"records"`
+	// ContentLength is the total original content length.
+	ContentLength int64 `json:"content_length"`
+	// CompressedLength is the total compressed content length.
+	CompressedLength int64 `json:"compressed_length"`
 }
 
 // TODO Add Head method, using cached info.
@@ -33,6 +120,43 @@ type Cache interface {
 // ErrCacheMiss occurs when a given URL is not in the cache.
 var ErrCacheMiss = errors.New("progszy: cache miss")
 
+// ErrNoSuchBin occurs when a given bin does not exist.
+var ErrNoSuchBin = errors.New("progszy: no such bin")
+
+// ErrInvalidBinKey occurs when a given bin key (base domain) is not valid.
+var ErrInvalidBinKey = errors.New("progszy: invalid bin key")
+
+// ErrInvalidNamespace occurs when a given namespace name is not valid.
+var ErrInvalidNamespace = errors.New("progszy: invalid namespace")
+
+// validBinKey reports whether the given bin key is safe to use in a bin's
+// filename: it must not be empty, nor contain a path separator or "..".
+// This prevents path traversal, as keys may come from the admin API.
+func validBinKey(bd string) bool {
+	return len(bd) > 0 && !strings.ContainsAny(bd, `/\`) && !strings.Contains(bd, "..")
+}
+
+// maxNamespaceLen is the maximum length of a namespace name.
+const maxNamespaceLen = 64
+
+// validNamespace reports whether the given namespace name is valid:
+// letters, digits, '.', '-' and '_', starting with a letter or digit.
+// This prevents path traversal, e.g. "..", when used as a folder name.
+func validNamespace(name string) bool {
+	if len(name) == 0 || len(name) > maxNamespaceLen {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case i > 0 && (r == '.' || r == '-' || r == '_'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 type CacheRecord struct {
 	// Key is the normalised URL.
 	Key string
@@ -52,7 +176,11 @@ type CacheRecord struct {
 	ETag string
 	// LastModified value (or empty string).
 	LastModified string
+	// Location value of a cached redirect (or empty string).
+	Location string
 	// ZstdBody holds the Zstd compressed HTTP body.
+	// It is nil for large bodies read from the cache,
+	// which are instead stored in chunks - see Body.
 	ZstdBody []byte
 	// CompressedLength is the length of ZstdBody.
 	CompressedLength int64
@@ -64,14 +192,104 @@ type CacheRecord struct {
 	MD5 string
 	// Created is the time this record was created.
 	Created time.Time
+	// LastAccessed is the time this record was last read from the cache
+	// (or the zero time, if never).
+	LastAccessed time.Time
+	// HitCount is the number of times this record has been read from the cache.
+	HitCount int64
+	// Imported is the time this record was imported, e.g. from a WARC
+	// file (or the zero time, if it wasn't). Created is then the original
+	// capture time, so any TTL runs from Imported instead.
+	Imported time.Time
+	// Bin is the filename of the bin this record was read from,
+	// or stored in (or empty string, if unknown).
+	Bin string
+
+	// spool holds a body that is yet to be stored.
+	spool *spooledBody
+	// openStored returns a reader over a stored body,
+	// which is chunked, or not yet read from the cache.
+	openStored func() (io.ReadCloser, error)
 }
 
+// Body returns a reader over the uncompressed HTTP body.
+// The body is decompressed as it is read, so memory use is constant
+// regardless of body size. The caller must close the returned reader.
 func (r *CacheRecord) Body() (io.ReadCloser, error) {
-	body, err := gozstd.Decompress(nil, r.ZstdBody)
+	zr, err := r.zstdReader()
 	if err != nil {
 		return nil, err
 	}
-	return io.NopCloser(bytes.NewReader(body)), nil
+	return &zstdReadCloser{Reader: gozstd.NewReader(zr), src: zr}, nil
+}
+
+// zstdReadCloser decompresses from src, releasing its resources on Close.
+type zstdReadCloser struct {
+	*gozstd.Reader
+	src io.Closer
+}
+
+func (rc *zstdReadCloser) Close() error {
+	if rc.Reader == nil {
+		// Already closed.
+		return nil
+	}
+	rc.Reader.Release()
+	rc.Reader = nil
+	return rc.src.Close()
+}
+
+// zstdReader returns a reader over the Zstd compressed HTTP body,
+// wherever it is held.
+func (r *CacheRecord) zstdReader() (io.ReadCloser, error) {
+	switch {
+	case r.ZstdBody != nil:
+		return io.NopCloser(bytes.NewReader(r.ZstdBody)), nil
+	case r.spool != nil:
+		return io.NopCloser(r.spool.zstdReader()), nil
+	case r.openStored != nil:
+		return r.openStored()
+	}
+	return io.NopCloser(bytes.NewReader(nil)), nil
+}
+
+// ResponseHead returns the status line and headers of the original
+// HTTP response, as reconstructed from the record.
+func (r *CacheRecord) ResponseHead() string {
+	proto := r.Protocol
+	if len(proto) == 0 {
+		proto = "HTTP/1.1"
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %d %s\r\n", proto, r.Status, http.StatusText(r.Status))
+	for _, f := range responseHeaders(r) {
+		fmt.Fprintf(&sb, "%s: %s\r\n", f.name, f.value)
+	}
+	sb.WriteString("\r\n")
+	return sb.String()
+}
+
+// headerField is a named header field.
+type headerField struct {
+	name, value string
+}
+
+// responseHeaders reconstructs the headers of the
+// original HTTP response, from the cache record.
+func responseHeaders(cr *CacheRecord) []headerField {
+	var fields []headerField
+	add := func(name, value string) {
+		if len(value) > 0 {
+			fields = append(fields, headerField{name, value})
+		}
+	}
+	add("Content-Type", cr.ContentType)
+	add("Content-Language", cr.ContentLanguage)
+	add("ETag", cr.ETag)
+	add("Last-Modified", cr.LastModified)
+	add("Location", cr.Location)
+	add("Content-Length", strconv.FormatInt(cr.ContentLength, 10))
+	return fields
 }
 
 const logCompressionStats = false
@@ -81,7 +299,19 @@ func (r *CacheRecord) SetBody(body []byte) error {
 	start := time.Now()
 
 	// cbody := gozstd.Compress(nil, body) // Default compression level.
-	cbody := gozstd.CompressLevel(nil, body, 20)
+	// cbody := gozstd.CompressLevel(nil, body, 20)
+	// (As for spooled bodies, the window size is capped, see zstdWriterParams.)
+	var buf bytes.Buffer
+	zw := gozstd.NewWriterParams(&buf, &zstdWriterParams)
+	_, err := zw.Write(body)
+	if err == nil {
+		err = zw.Close()
+	}
+	zw.Release()
+	if err != nil {
+		return err
+	}
+	cbody := buf.Bytes()
 
 	if logCompressionStats {
 		clen := int64(len(cbody))
@@ -102,9 +332,53 @@ func (r *CacheRecord) SetBody(body []byte) error {
 	return nil
 }
 
+// importedAt returns Imported, for storing, as NULL if zero.
+func (r *CacheRecord) importedAt() sql.NullTime {
+	return sql.NullTime{Time: r.Imported.UTC(), Valid: !r.Imported.IsZero()}
+}
+
+// setSpooledBody is SetBody for a body held in temporary files.
+// Small bodies are read into ZstdBody, otherwise the spool is
+// retained until the record is stored (the caller remains
+// responsible for closing it).
+func (r *CacheRecord) setSpooledBody(b *spooledBody) error {
+	r.MD5 = b.md5
+	r.CompressedLength = b.compressedSize
+	r.ContentLength = b.size
+
+	if b.compressedSize > chunkSize {
+		r.ZstdBody = nil
+		r.spool = b
+		return nil
+	}
+	cbody := make([]byte, b.compressedSize)
+	_, err := io.ReadFull(b.zstdReader(), cbody)
+	if err != nil {
+		return err
+	}
+	r.ZstdBody = cbody
+	r.spool = nil
+	return nil
+}
+
 // TODO cacheRecord should hold ETag, LastModified, Content-Length(?), md5(?)
 
 func NewCacheRecord(uri string, status int, proto, lang, mime, etag, lastMod string, body []byte, responseTime float64, created time.Time) (*CacheRecord, error) {
+	r, err := newCacheRecord(uri, status, proto, lang, mime, etag, lastMod, responseTime, created)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.SetBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// newCacheRecord returns a CacheRecord without a body.
+func newCacheRecord(uri string, status int, proto, lang, mime, etag, lastMod string, responseTime float64, created time.Time) (*CacheRecord, error) {
 
 	nurl, bd, err := cacheRecordKey(uri)
 	if err != nil {
@@ -124,12 +398,6 @@ func NewCacheRecord(uri string, status int, proto, lang, mime, etag, lastMod str
 		ResponseTime:    responseTime,
 		Created:         created.UTC(),
 	}
-
-	err = r.SetBody(body)
-	if err != nil {
-		return nil, err
-	}
-
 	return r, nil
 }
 
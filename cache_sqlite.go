@@ -1,10 +1,16 @@
 package progszy
 
 import (
+	"bytes"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"io"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
@@ -38,31 +44,131 @@ import (
 
 const fileExt = ".sqlite"
 
+// chunkSize is the maximum size of the compressed body stored in a single blob.
+// Larger bodies are stored as a sequence of chunks, so they can be
+// written and read incrementally.
+const chunkSize = 1024 * 1024 // 1mb
+
 type SqliteCache struct {
 	path           string
+	binner         Binner
 	mu             sync.RWMutex
 	dbByBaseDomain map[string]*sql.DB
+	// fileByBaseDomain holds the filename of each open current bin.
+	fileByBaseDomain map[string]string
+	// dbByFile holds handles to bins opened by filename.
+	dbByFile map[string]*fileDB
+	// retired holds rotated out handles, to close at CloseAll.
+	retired    []*sql.DB
+	nsMu       sync.Mutex
+	namespaces map[string]*SqliteCache
 }
 
-// TODO(js) To prevent issues if/when rotating out an in-use db, perhaps we should have a RWMutex around each db?
-
-// NewSqliteCache initialises and returns a new SqliteCache.
+// NewSqliteCache initialises and returns a new SqliteCache,
+// which bins URLs by their base domain.
 func NewSqliteCache(cachePath string) *SqliteCache {
+	return NewSqliteCacheWithBinner(cachePath, RootDomainBinner)
+}
+
+// NewSqliteCacheWithBinner initialises and returns a new SqliteCache,
+// which uses the given Binner to decide which bin each URL belongs in.
+func NewSqliteCacheWithBinner(cachePath string, binner Binner) *SqliteCache {
+	if binner == nil {
+		binner = RootDomainBinner
+	}
 	c := SqliteCache{
-		path:           cachePath,
-		dbByBaseDomain: make(map[string]*sql.DB),
+		path:             cachePath,
+		binner:           binner,
+		dbByBaseDomain:   make(map[string]*sql.DB),
+		fileByBaseDomain: make(map[string]string),
+		dbByFile:         make(map[string]*fileDB),
+		namespaces:       make(map[string]*SqliteCache),
 	}
 	return &c
 }
 
+// Namespace returns the cache for the named namespace, whose bins are
+// held in a subfolder of the cache folder. An empty name returns this cache.
+// If the name is not valid, error ErrInvalidNamespace is returned.
+func (c *SqliteCache) Namespace(name string) (Cache, error) {
+	ns, err := c.namespace(name)
+	if err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+func (c *SqliteCache) namespace(name string) (*SqliteCache, error) {
+	if len(name) == 0 {
+		return c, nil
+	}
+	if !validNamespace(name) {
+		return nil, ErrInvalidNamespace
+	}
+	c.nsMu.Lock()
+	defer c.nsMu.Unlock()
+	ns, ok := c.namespaces[name]
+	if !ok {
+		ns = NewSqliteCacheWithBinner(filepath.Join(c.path, name), c.binner)
+		c.namespaces[name] = ns
+	}
+	return ns, nil
+}
+
+// Namespaces lists the namespaces in the cache folder.
+func (c *SqliteCache) Namespaces() ([]string, error) {
+	entries, err := os.ReadDir(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && validNamespace(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// binKey returns the normalised URL (key) for the given URL,
+// and the name of the bin it belongs in.
+func (c *SqliteCache) binKey(uri string) (string, string, error) {
+	nurl, _, err := cacheRecordKey(uri)
+	if err != nil {
+		return "", "", err
+	}
+	u, err := url.Parse(nurl)
+	if err != nil {
+		return "", "", err
+	}
+	bin, err := c.binner.Bin(u)
+	if err != nil {
+		return "", "", err
+	}
+	return nurl, safeBinName(bin), nil
+}
+
 // Get the cached response for the given URL.
 // If the given URL does not exist in the cache,
 // error ErrCacheMiss is returned.
 func (c *SqliteCache) Get(uri string) (*CacheRecord, error) {
+	return c.get(uri, true)
+}
+
+// Peek gets the cached response for the given URL, like Get,
+// but without tracking the access, so it doesn't count as a hit.
+func (c *SqliteCache) Peek(uri string) (*CacheRecord, error) {
+	return c.get(uri, false)
+}
+
+func (c *SqliteCache) get(uri string, touch bool) (*CacheRecord, error) {
 
 	// log.Println("Called Get")
 
-	nurl, bd, err := cacheRecordKey(uri)
+	nurl, bd, err := c.binKey(uri)
 	if err != nil {
 		return nil, err
 	}
@@ -89,13 +195,133 @@ func (c *SqliteCache) Get(uri string) (*CacheRecord, error) {
 		return nil, ErrCacheMiss
 	}
 
+	if touch {
+		// Track usage, for LRU eviction.
+		now := time.Now().UTC()
+		_, err = db.Exec(touchSQL, now, r.Key, r.ContentLanguage, r.ContentType)
+		if err != nil {
+			// Only bookkeeping, e.g. the bin may be locked by a large insert.
+			log.Printf("Error tracking access to %s: %v\n", r.Key, err)
+		} else {
+			r.LastAccessed = now
+			r.HitCount++
+		}
+	}
+	r.Bin = c.binFile(bd)
+
+	return r, nil
+}
+
+// GetAsOf gets the cached response for the given URL as it was at the given
+// time, from the newest bin created at or before then: either its current
+// record, if that was created by then, or else the newest such record in the
+// bin's history. If there is no such record, error ErrCacheMiss is returned.
+// Bins named by older versions only have minute resolution, so such a bin
+// named for the same minute as the given time may have been created after it:
+// if that bin has no such record, the next older bin is used instead.
+func (c *SqliteCache) GetAsOf(uri string, asOf time.Time) (*CacheRecord, error) {
+	nurl, bd, err := c.binKey(uri)
+	if err != nil {
+		return nil, err
+	}
+	files, err := c.binFiles(bd)
+	if err != nil {
+		return nil, err
+	}
+	asOf = asOf.UTC()
+	// Files are sorted, so search from the newest.
+	for i := len(files) - 1; i >= 0; i-- {
+		_, created, _ := parseBinName(filepath.Base(files[i]))
+		if created.After(asOf) {
+			continue
+		}
+		r, err := c.queryFile(files[i], queryAsOfSQL, nurl, asOf, nurl, asOf)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			if created.Equal(asOf.Truncate(time.Minute)) {
+				// The bin may be newer than asOf, try the previous one.
+				continue
+			}
+			return nil, ErrCacheMiss
+		}
+		return r, nil
+	}
+	return nil, ErrCacheMiss
+}
+
+// GetPrevious gets the newest cached response for the given URL that is
+// no longer current: from the history of the current bin, or else from
+// the older bins (and their history), searching from the newest.
+// If there is none, error ErrCacheMiss is returned.
+func (c *SqliteCache) GetPrevious(uri string) (*CacheRecord, error) {
+	nurl, bd, err := c.binKey(uri)
+	if err != nil {
+		return nil, err
+	}
+	files, err := c.binFiles(bd)
+	if err != nil {
+		return nil, err
+	}
+	// Files are sorted, so the last one is the current bin.
+	for i := len(files) - 1; i >= 0; i-- {
+		var r *CacheRecord
+		if i == len(files)-1 {
+			r, err = c.queryFile(files[i], queryHistorySQL, nurl)
+		} else {
+			r, err = c.queryFile(files[i], queryLatestSQL, nurl, nurl)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			return r, nil
+		}
+	}
+	return nil, ErrCacheMiss
+}
+
+// binFiles returns the sorted filenames of all bins with the given key.
+func (c *SqliteCache) binFiles(bd string) ([]string, error) {
+	files, err := filterFiles(c.path, bd, fileExt)
+	if err != nil {
+		return nil, err
+	}
+	// (The prefix also matches other domains, e.g. example.com.au)
+	var bins []string
+	for _, file := range files {
+		name, _, ok := parseBinName(filepath.Base(file))
+		if ok && name == bd {
+			bins = append(bins, file)
+		}
+	}
+	return bins, nil
+}
+
+// queryFile returns the record selected by the given query
+// from the given bin file, or nil if there is none.
+func (c *SqliteCache) queryFile(filename, query string, args ...interface{}) (*CacheRecord, error) {
+	f, err := c.getFileDB(filename)
+	if err != nil {
+		return nil, err
+	}
+	r, err := queryRecord(f.db, f.query(query), args...)
+	if err != nil || r == nil {
+		return nil, err
+	}
+	r.Bin = filepath.Base(filename)
 	return r, nil
 }
 
 func fetchRecord(db *sql.DB, nurl string) (*CacheRecord, error) {
-	row := db.QueryRow(querySQL, nurl)
-	r := CacheRecord{}
-	err := row.Scan(&r.Key, &r.URL, &r.BaseDomain, &r.Status, &r.Protocol, &r.ContentLanguage, &r.ContentType, &r.ETag, &r.LastModified, &r.ZstdBody, &r.CompressedLength, &r.ContentLength, &r.ResponseTime, &r.MD5, &r.Created)
+	return queryRecord(db, querySQL, nurl)
+}
+
+// queryRecord returns the record selected by the given query,
+// or nil if there is none.
+func queryRecord(db *sql.DB, query string, args ...interface{}) (*CacheRecord, error) {
+	r, err := scanRecord(db, db.QueryRow(query, args...))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -103,9 +329,69 @@ func fetchRecord(db *sql.DB, nurl string) (*CacheRecord, error) {
 		// TODO(js) Improve error handling.
 		return nil, err
 	}
+	return r, nil
+}
+
+// scanRecord scans a record (with its body), read from the given db.
+func scanRecord(db *sql.DB, row interface{ Scan(...interface{}) error }) (*CacheRecord, error) {
+	r := CacheRecord{}
+	var ref string
+	var accessed, imported sql.NullTime
+	err := row.Scan(&r.Key, &r.URL, &r.BaseDomain, &r.Status, &r.Protocol, &r.ContentLanguage, &r.ContentType, &r.ETag, &r.LastModified, &r.ZstdBody, &r.CompressedLength, &r.ContentLength, &r.ResponseTime, &r.MD5, &r.Created, &r.Location, &ref, &accessed, &r.HitCount, &imported)
+	if err != nil {
+		return nil, err
+	}
+	r.LastAccessed = accessed.Time
+	r.Imported = imported.Time
+	if len(ref) > 0 {
+		r.openStored = func() (io.ReadCloser, error) {
+			return io.NopCloser(&chunkReader{db: db, ref: ref}), nil
+		}
+	}
 	return &r, nil
 }
 
+// storedBody returns a function that reads the stored body of
+// the given record from the given db, whether chunked or not.
+func storedBody(f *fileDB, r *CacheRecord) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		var body []byte
+		var ref string
+		err := f.db.QueryRow(f.query(queryBodySQL), r.Key, r.ContentLanguage, r.ContentType).Scan(&body, &ref)
+		if err != nil {
+			return nil, err
+		}
+		if len(ref) > 0 {
+			return io.NopCloser(&chunkReader{db: f.db, ref: ref}), nil
+		}
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// chunkReader reads a chunked body, one chunk at a time.
+type chunkReader struct {
+	db  *sql.DB
+	ref string
+	seq int
+	buf []byte
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		err := cr.db.QueryRow(queryChunkSQL, cr.ref, cr.seq).Scan(&cr.buf)
+		if err == sql.ErrNoRows {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		cr.seq++
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
 // Put adds the given URL/response pair to the cache.
 func (c *SqliteCache) Put(cr *CacheRecord) error {
 
@@ -116,65 +402,856 @@ func (c *SqliteCache) Put(cr *CacheRecord) error {
 	// 	return err
 	// }
 
-	db, err := c.getOrCreateDB(cr.BaseDomain)
+	_, bd, err := c.binKey(cr.Key)
+	if err != nil {
+		return err
+	}
+	db, err := c.getOrCreateDB(bd)
+	if err != nil {
+		return err
+	}
+
+	err = insertRecord(db, cr, replaceNone)
+	// if err != nil {
+	// 	log.Printf("insert error %v", err)
+	// }
+	if err == nil {
+		cr.Bin = c.binFile(bd)
+	}
+	return err
+}
+
+// Replace adds the given URL/response pair to the cache,
+// replacing any existing response for the URL. If keep is true,
+// the existing response is kept in the bin's history, as a
+// previous version, otherwise it is deleted.
+func (c *SqliteCache) Replace(cr *CacheRecord, keep bool) error {
+	_, bd, err := c.binKey(cr.Key)
+	if err != nil {
+		return err
+	}
+	db, err := c.getOrCreateDB(bd)
+	if err != nil {
+		return err
+	}
+	mode := replaceDelete
+	if keep {
+		mode = replaceKeep
+	}
+	err = insertRecord(db, cr, mode)
+	if err == nil {
+		cr.Bin = c.binFile(bd)
+	}
+	return err
+}
+
+// Refresh updates the created time, ETag and Last-Modified
+// of the given cached response, to those of the given record
+// (and, as it is then fresh from upstream, clears its import time).
+func (c *SqliteCache) Refresh(cr *CacheRecord) error {
+	_, bd, err := c.binKey(cr.Key)
+	if err != nil {
+		return err
+	}
+	db, err := c.getDB(bd)
+	if err != nil {
+		return err
+	}
+	if db == nil {
+		return ErrCacheMiss
+	}
+	res, err := db.Exec(refreshSQL, cr.Created, cr.ETag, cr.LastModified, cr.Key, cr.ContentLanguage, cr.ContentType)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCacheMiss
+	}
+	return nil
+}
+
+// Modes of insertRecord, for any existing record.
+const (
+	replaceNone   = iota // Keep the existing record (ignore the insert).
+	replaceDelete        // Delete the existing record.
+	replaceKeep          // Move the existing record into the history.
+)
+
+func insertRecord(db *sql.DB, r *CacheRecord, mode int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	switch mode {
+	case replaceDelete:
+		_, err = deleteRecord(tx, r.Key)
+	case replaceKeep:
+		err = archiveRecord(tx, r.Key)
+	}
+	if err != nil {
+		return err
+	}
+
+	if r.CompressedLength <= chunkSize {
+		_, err = tx.Exec(insertSQL, r.Key, r.URL, r.BaseDomain, r.Status, r.Protocol, r.ContentLanguage, r.ContentType, r.ETag, r.LastModified, r.ZstdBody, r.CompressedLength, r.ContentLength, r.ResponseTime, r.MD5, r.Created, r.Location, "", r.importedAt())
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	// Large bodies get stored in chunks, leaving the content column NULL.
+	ref, err := newContentRef()
+	if err != nil {
+		return err
+	}
+	zr, err := r.zstdReader()
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	res, err := tx.Exec(insertSQL, r.Key, r.URL, r.BaseDomain, r.Status, r.Protocol, r.ContentLanguage, r.ContentType, r.ETag, r.LastModified, nil, r.CompressedLength, r.ContentLength, r.ResponseTime, r.MD5, r.Created, r.Location, ref, r.importedAt())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// Record already exists (insert was ignored).
+		return nil
+	}
+	err = insertChunks(tx, ref, zr)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteRecord deletes all records for the given normalised URL,
+// along with any chunks of their bodies, returning the number of
+// records deleted.
+func deleteRecord(tx *sql.Tx, nurl string) (int64, error) {
+	_, err := tx.Exec(deleteChunksSQL, nurl)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(deleteSQL, nurl)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// archiveRecord moves the record for the given URL (and its chunks)
+// into the history.
+func archiveRecord(tx *sql.Tx, nurl string) error {
+	_, err := tx.Exec(archiveSQL, time.Now().UTC(), nurl)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(deleteSQL, nurl)
+	return err
+}
+
+// Versions returns all versions of the cached response for the given URL,
+// newest first: the current record, followed by those in the history of
+// its current bin. Only versions of the same variant (content language
+// and content type) as the current record, or else the newest in the
+// history, are included. The current record is not counted as a hit.
+func (c *SqliteCache) Versions(uri string) ([]*CacheRecord, error) {
+	nurl, bd, err := c.binKey(uri)
+	if err != nil {
+		return nil, err
+	}
+	db, err := c.getDB(bd)
+	if err != nil {
+		return nil, err
+	}
+	if db == nil {
+		return nil, nil
+	}
+	latest, err := fetchRecord(db, nurl)
+	if err == nil && latest == nil {
+		latest, err = queryRecord(db, queryLatestSQL, nurl, nurl)
+	}
+	if err != nil || latest == nil {
+		return nil, err
+	}
+	lang, ctype := latest.ContentLanguage, latest.ContentType
+	rows, err := db.Query(variantVersionsSQL, nurl, lang, ctype, nurl, lang, ctype)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var versions []*CacheRecord
+	for rows.Next() {
+		r, err := scanRecord(db, rows)
+		if err != nil {
+			return nil, err
+		}
+		r.Bin = c.binFile(bd)
+		versions = append(versions, r)
+	}
+	return versions, rows.Err()
+}
+
+// Delete removes the cached response for the given URL.
+// If the given URL does not exist in the cache,
+// error ErrCacheMiss is returned.
+func (c *SqliteCache) Delete(uri string) error {
+	nurl, bd, err := c.binKey(uri)
+	if err != nil {
+		return err
+	}
+	db, err := c.getDB(bd)
+	if err != nil {
+		return err
+	}
+	if db == nil {
+		return ErrCacheMiss
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	n, err := deleteRecord(tx, nurl)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCacheMiss
+	}
+	return tx.Commit()
+}
+
+func insertChunks(tx *sql.Tx, ref string, r io.Reader) error {
+	buf := make([]byte, chunkSize)
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			_, err2 := tx.Exec(insertChunkSQL, ref, seq, buf[:n])
+			if err2 != nil {
+				return err2
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// newContentRef returns a random identifier for a chunked body.
+func newContentRef() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (c *SqliteCache) CloseAll() error {
+	c.nsMu.Lock()
+	for _, ns := range c.namespaces {
+		ns.CloseAll()
+	}
+	c.namespaces = make(map[string]*SqliteCache)
+	c.nsMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for bd, db := range c.dbByBaseDomain {
+		err := db.Close()
+		if err != nil {
+			// TODO(js) Improve error handling.
+			log.Printf("Error closing %s db: %v", bd, err)
+		}
+	}
+	c.dbByBaseDomain = make(map[string]*sql.DB)
+	c.fileByBaseDomain = make(map[string]string)
+	for file, f := range c.dbByFile {
+		err := f.db.Close()
+		if err != nil {
+			log.Printf("Error closing %s db: %v", file, err)
+		}
+	}
+	c.dbByFile = make(map[string]*fileDB)
+	for _, db := range c.retired {
+		db.Close()
+	}
+	c.retired = nil
+	return nil
+}
+
+// DeleteMatching removes the cached responses for all URLs in the
+// given URL's current bin whose normalised URL (key) matches,
+// returning how many URLs were removed.
+func (c *SqliteCache) DeleteMatching(uri string, match func(key string) bool) (int, error) {
+	_, bd, err := c.binKey(uri)
+	if err != nil {
+		return 0, err
+	}
+	db, err := c.getDB(bd)
+	if err != nil {
+		return 0, err
+	}
+	if db == nil {
+		return 0, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var keys []string
+	rows, err := tx.Query(keysSQL)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var nurl string
+		err = rows.Scan(&nurl)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if match(nurl) {
+			keys = append(keys, nurl)
+		}
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, nurl := range keys {
+		_, err = deleteRecord(tx, nurl)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), tx.Commit()
+}
+
+// Expire removes records created before the given time from the base domain's
+// current bin, returning how many were removed. If archive is true, the records
+// (and their bodies) are moved into the bin's history, otherwise they are deleted.
+func (c *SqliteCache) Expire(bd string, before time.Time, archive bool) (int, error) {
+	db, err := c.getDB(bd)
+	if err != nil {
+		return 0, err
+	}
+	if db == nil {
+		return 0, nil
+	}
+	before = before.UTC()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if archive {
+		_, err = tx.Exec(archiveExpiredSQL, time.Now().UTC(), before)
+	} else {
+		_, err = tx.Exec(deleteExpiredChunksSQL, before)
+	}
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(deleteExpiredSQL, before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+// binUsage is the space used by a base domain's bins, in one cache
+// or namespace, for Trim.
+type binUsage struct {
+	cache *SqliteCache
+	bd    string
+	// db is the current bin, if any, and used is the
+	// compressed size of its records and their history.
+	db   *sql.DB
+	used int64
+	// old are the older bins, oldest first, whose file sizes are used.
+	old []BinInfo
+}
+
+func (u *binUsage) size() int64 {
+	n := u.used
+	for _, b := range u.old {
+		n += b.Size
+	}
+	return n
+}
+
+// lruEntry is a record, or a record in the history,
+// as a candidate for LRU eviction.
+type lruEntry struct {
+	usage    *binUsage
+	history  bool
+	rowid    int64
+	size     int64
+	accessed string
+}
+
+// lruCursor iterates over a bin's records and history, least recently used first.
+type lruCursor struct {
+	usage *binUsage
+	rows  *sql.Rows
+	next  *lruEntry
+}
+
+func newLRUCursor(u *binUsage) (*lruCursor, error) {
+	rows, err := u.db.Query(lruSQL)
+	if err != nil {
+		return nil, err
+	}
+	lc := &lruCursor{usage: u, rows: rows}
+	return lc, lc.advance()
+}
+
+// advance reads the next entry, which is nil at the end.
+func (lc *lruCursor) advance() error {
+	lc.next = nil
+	if !lc.rows.Next() {
+		return lc.rows.Err()
+	}
+	e := lruEntry{usage: lc.usage}
+	err := lc.rows.Scan(&e.history, &e.rowid, &e.size, &e.accessed)
+	if err != nil {
+		return err
+	}
+	lc.next = &e
+	return nil
+}
+
+// Trim evicts the least recently used records from the cache, until each
+// base domain is within its quota, and all are within the total quota,
+// returning how many were evicted. The cache's namespaces are included,
+// and the total quota applies to them all together. Quotas are in
+// compressed bytes, zero is unlimited. Old bins are counted by their
+// file size, and are deleted first, oldest first, before any records.
+// History counts as used when archived, and is evicted along with the
+// current records.
+func (c *SqliteCache) Trim(quota func(bd string) int64, totalQuota int64) (int, error) {
+	usages, err := c.binUsages(quota, totalQuota > 0)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	evicted := 0
+	for _, u := range usages {
+		if q := quota(u.bd); q > 0 && u.size() > q {
+			n, err := trimUsages([]*binUsage{u}, u.size()-q)
+			evicted += n
+			if err != nil {
+				return evicted, err
+			}
+		}
+		total += u.size()
+	}
+	if totalQuota > 0 && total > totalQuota {
+		n, err := trimUsages(usages, total-totalQuota)
+		evicted += n
+		if err != nil {
+			return evicted, err
+		}
+	}
+	return evicted, nil
+}
+
+// binUsages returns the usage of each base domain's bins, across the
+// cache and its namespaces. Only base domains with a quota are included,
+// unless all are requested.
+func (c *SqliteCache) binUsages(quota func(bd string) int64, all bool) ([]*binUsage, error) {
+	caches := []*SqliteCache{c}
+	names, err := c.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		ns, err := c.namespace(name)
+		if err != nil {
+			return nil, err
+		}
+		caches = append(caches, ns)
+	}
+
+	var usages []*binUsage
+	for _, cache := range caches {
+		bins, err := cache.Bins()
+		if err != nil {
+			return nil, err
+		}
+		byBaseDomain := make(map[string]*binUsage)
+		for _, b := range bins {
+			if !all && quota(b.BaseDomain) <= 0 {
+				continue
+			}
+			u, ok := byBaseDomain[b.BaseDomain]
+			if !ok {
+				u = &binUsage{cache: cache, bd: b.BaseDomain}
+				byBaseDomain[b.BaseDomain] = u
+				usages = append(usages, u)
+			}
+			if !b.Current {
+				// Bins are sorted, so these are oldest first.
+				u.old = append(u.old, b)
+				continue
+			}
+			db, err := cache.getDB(b.BaseDomain)
+			if err != nil {
+				return nil, err
+			}
+			if db == nil {
+				continue
+			}
+			err = db.QueryRow(usedSQL).Scan(&u.used)
+			if err != nil {
+				return nil, err
+			}
+			u.db = db
+		}
+	}
+	return usages, nil
+}
+
+// trimUsages frees at least excess bytes from the given usages, first by
+// deleting old bins, oldest first, then by evicting the least recently
+// used records, updating the usages. It returns how many records were
+// evicted.
+func trimUsages(usages []*binUsage, excess int64) (int, error) {
+	for excess > 0 {
+		var oldest *binUsage
+		for _, u := range usages {
+			if len(u.old) > 0 && (oldest == nil || u.old[0].Created.Before(oldest.old[0].Created)) {
+				oldest = u
+			}
+		}
+		if oldest == nil {
+			break
+		}
+		b := oldest.old[0]
+		err := oldest.cache.removeBin(b.Name)
+		if err != nil {
+			return 0, err
+		}
+		log.Printf("Deleted old bin %s", b.Name)
+		oldest.old = oldest.old[1:]
+		excess -= b.Size
+	}
+	if excess <= 0 {
+		return 0, nil
+	}
+	return evictLRU(usages, excess)
+}
+
+// evictLRU evicts the least recently used records across the current bins
+// of the given usages, until at least excess bytes have been freed, returning
+// how many records were evicted. Victims are chosen without holding the
+// cache's lock, then deleted bin by bin, unless the bin has been rotated.
+func evictLRU(usages []*binUsage, excess int64) (int, error) {
+	// Merge the bins' records, in order of access, to find the victims.
+	var cursors []*lruCursor
+	defer func() {
+		for _, lc := range cursors {
+			lc.rows.Close()
+		}
+	}()
+	for _, u := range usages {
+		if u.db == nil {
+			continue
+		}
+		lc, err := newLRUCursor(u)
+		if err != nil {
+			return 0, err
+		}
+		cursors = append(cursors, lc)
+	}
+	victims := make(map[*binUsage][]*lruEntry)
+	var freed int64
+	for freed < excess {
+		var oldest *lruCursor
+		for _, lc := range cursors {
+			// Times are all stored in UTC, in the same format, so they sort as strings.
+			if lc.next != nil && (oldest == nil || lc.next.accessed < oldest.next.accessed) {
+				oldest = lc
+			}
+		}
+		if oldest == nil {
+			break
+		}
+		victims[oldest.usage] = append(victims[oldest.usage], oldest.next)
+		freed += oldest.next.size
+		err := oldest.advance()
+		if err != nil {
+			return 0, err
+		}
+	}
+	// Reads must be finished before we can write.
+	for _, lc := range cursors {
+		lc.rows.Close()
+	}
+
+	evicted := 0
+	for u, entries := range victims {
+		if !u.cache.isCurrentDB(u.bd, u.db) {
+			// Rotated since we looked, its records are now in an old bin.
+			continue
+		}
+		for _, e := range entries {
+			err := deleteLRUEntry(u.db, e)
+			if err != nil {
+				return evicted, err
+			}
+			u.used -= e.size
+			evicted++
+		}
+	}
+	return evicted, nil
+}
+
+// deleteLRUEntry deletes the given record, or record in the
+// history, along with any chunks of its body.
+func deleteLRUEntry(db *sql.DB, e *lruEntry) error {
+	chunksSQL, recordSQL := deleteLRUChunksSQL, deleteLRUSQL
+	if e.history {
+		chunksSQL, recordSQL = deleteLRUHistoryChunksSQL, deleteLRUHistorySQL
+	}
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-
-	err = insertRecord(db, cr)
-	// if err != nil {
-	// 	log.Printf("insert error %v", err)
-	// }
-	return err
+	defer tx.Rollback()
+	_, err = tx.Exec(chunksSQL, e.rowid)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(recordSQL, e.rowid)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func insertRecord(db *sql.DB, r *CacheRecord) error {
-	_, err := db.Exec(insertSQL, r.Key, r.URL, r.BaseDomain, r.Status, r.Protocol, r.ContentLanguage, r.ContentType, r.ETag, r.LastModified, r.ZstdBody, r.CompressedLength, r.ContentLength, r.ResponseTime, r.MD5, r.Created)
-	return err
+// isCurrentDB reports whether db is still the handle
+// to the given base domain's current bin.
+func (c *SqliteCache) isCurrentDB(bd string, db *sql.DB) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.dbByBaseDomain[bd] == db
 }
 
-func (c *SqliteCache) CloseAll() error {
+// removeBin deletes the named old bin. Any open handle to it may
+// still be in use by other requests, so is only closed at CloseAll.
+func (c *SqliteCache) removeBin(name string) error {
+	filename := filepath.Join(c.path, name)
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	for bd, db := range c.dbByBaseDomain {
-		err := db.Close()
-		if err != nil {
-			// TODO(js) Improve error handling.
-			log.Printf("Error closing %s db: %v", bd, err)
+	if f, ok := c.dbByFile[filename]; ok {
+		delete(c.dbByFile, filename)
+		c.retired = append(c.retired, f.db)
+	}
+	c.mu.Unlock()
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		err := os.Remove(filename + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
 		}
 	}
-	c.dbByBaseDomain = make(map[string]*sql.DB)
 	return nil
 }
 
+// Flush starts a new bin for the given URL's bin.
 func (c *SqliteCache) Flush(uri string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	_, bd, err := cacheRecordKey(uri)
+	_, bd, err := c.binKey(uri)
 	if err != nil {
 		return err
 	}
+	return c.Rotate(bd)
+}
+
+// Rotate starts a new bin for the given base domain.
+// The old bin is left on disk, but is no longer used.
+// It returns ErrInvalidBinKey for a key that is not safe to use
+// in a filename.
+func (c *SqliteCache) Rotate(bd string) error {
+	if !validBinKey(bd) {
+		return ErrInvalidBinKey
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	log.Printf("Flushing cache for %s", bd)
 
 	// TODO Can we be cleverer when we flush? e.g. Check if existing db is empty, if so, remove it.
 	// TODO Also, if no db exists in map, and no db exists on filesystem, don't bother creating a new db. (It will happen automatically on first Put)
 
-	// Close existing db, if it exists.
+	// Other requests may still be using the existing db, if it exists,
+	// so rather than closing it, keep it open as an old bin until CloseAll.
 	db := c.dbByBaseDomain[bd]
 	if db != nil {
-		err = db.Close()
-		if err != nil {
-			// TODO(js) Improve error handling.
-			log.Printf("Error closing %s db: %v", bd, err)
+		filename := filepath.Join(c.path, c.fileByBaseDomain[bd])
+		if _, ok := c.dbByFile[filename]; ok {
+			c.retired = append(c.retired, db)
+		} else {
+			c.dbByFile[filename] = &fileDB{db: db}
 		}
 	}
 
 	// Create a new db.
-	_, err = c.createDB(bd)
+	_, err := c.createDB(bd)
 	return err
 }
 
+// Bins lists all bins in the cache folder.
+func (c *SqliteCache) Bins() ([]BinInfo, error) {
+	files, err := filterFiles(c.path, "", fileExt)
+	if err != nil {
+		return nil, err
+	}
+	var bins []BinInfo
+	current := make(map[string]int)
+	for _, file := range files {
+		name := filepath.Base(file)
+		bd, created, ok := parseBinName(name)
+		if !ok {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		bins = append(bins, BinInfo{
+			Name:       name,
+			BaseDomain: bd,
+			Created:    created,
+			Size:       info.Size(),
+		})
+		// Files are sorted, so the last one for each domain is current.
+		current[bd] = len(bins) - 1
+	}
+	for _, i := range current {
+		bins[i].Current = true
+	}
+	return bins, nil
+}
+
+// Walk calls fn for each record in the named bin, in URL order.
+// The records' bodies are not read from the bin unless requested,
+// which must be done during fn. If fn returns an error, the walk
+// stops and returns that error.
+func (c *SqliteCache) Walk(bin string, fn func(cr *CacheRecord) error) error {
+	bins, err := c.Bins()
+	if err != nil {
+		return err
+	}
+	var info *BinInfo
+	for i := range bins {
+		if bins[i].Name == bin {
+			info = &bins[i]
+		}
+	}
+	if info == nil {
+		return ErrNoSuchBin
+	}
+
+	f := &fileDB{}
+	if info.Current {
+		f.db, err = c.getDB(info.BaseDomain)
+	} else {
+		// Old bins aren't kept open.
+		f, err = openFileDB(filepath.Join(c.path, bin))
+		if err == nil {
+			defer f.db.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if f.db == nil {
+		return ErrNoSuchBin
+	}
+
+	rows, err := f.db.Query(f.query(walkSQL))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := CacheRecord{}
+		var accessed, imported sql.NullTime
+		err = rows.Scan(&r.Key, &r.URL, &r.BaseDomain, &r.Status, &r.Protocol, &r.ContentLanguage, &r.ContentType, &r.ETag, &r.LastModified, &r.CompressedLength, &r.ContentLength, &r.ResponseTime, &r.MD5, &r.Created, &r.Location, &accessed, &r.HitCount, &imported)
+		if err != nil {
+			return err
+		}
+		r.LastAccessed = accessed.Time
+		r.Imported = imported.Time
+		r.openStored = storedBody(f, &r)
+		err = fn(&r)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Stats returns statistics for the cache's current bins.
+func (c *SqliteCache) Stats() (*CacheStats, error) {
+	bins, err := c.Bins()
+	if err != nil {
+		return nil, err
+	}
+	stats := &CacheStats{
+		Bins:    len(bins),
+		Domains: make(map[string]*DomainStats),
+	}
+	for _, b := range bins {
+		stats.Size += b.Size
+		if !b.Current {
+			continue
+		}
+		db, err := c.getDB(b.BaseDomain)
+		if err != nil {
+			return nil, err
+		}
+		if db == nil {
+			continue
+		}
+		ds := DomainStats{}
+		err = db.QueryRow(statsSQL).Scan(&ds.Records, &ds.ContentLength, &ds.CompressedLength)
+		if err != nil {
+			return nil, err
+		}
+		stats.Domains[b.BaseDomain] = &ds
+	}
+	return stats, nil
+}
+
 // findDatabase()
 //  - do we know its file location already?
 //   - use domain-slug as map key, rlock the map first.
@@ -207,22 +1284,24 @@ func (c *SqliteCache) getOrCreateDB(bd string) (*sql.DB, error) {
 
 func (c *SqliteCache) getDB(bd string) (*sql.DB, error) {
 	c.mu.RLock()
-	defer c.mu.RUnlock()
-
 	db, ok := c.dbByBaseDomain[bd]
+	c.mu.RUnlock()
 	if ok {
 		return db, nil
 	}
 
 	// No database handle exists in the map.
 	// Does a suitably named database already exist on the filesystem?
+	// (findDB adds to the maps, so needs the wlock.)
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	db, err := c.findDB(bd)
-	if err != nil {
-		return nil, err
+	db, ok = c.dbByBaseDomain[bd]
+	if ok {
+		// Must've come from another goroutine, inbetween the rlock and wlock.
+		return db, nil
 	}
-
-	return db, nil
+	return c.findDB(bd)
 }
 
 func (c *SqliteCache) findOrCreateDB(bd string) (*sql.DB, error) {
@@ -256,7 +1335,11 @@ func (c *SqliteCache) findOrCreateDB(bd string) (*sql.DB, error) {
 func (c *SqliteCache) createDB(bd string) (*sql.DB, error) {
 	// (Assumes we're already wlocked.)
 
-	// Make a new db.
+	// Make a new db. (A namespace's folder may not exist yet.)
+	err := os.MkdirAll(c.path, 0755)
+	if err != nil {
+		return nil, err
+	}
 	filename := filepath.Join(c.path, bd+"-"+timestamp()+fileExt)
 	db, err := createDB(filename)
 	if err != nil {
@@ -265,12 +1348,13 @@ func (c *SqliteCache) createDB(bd string) (*sql.DB, error) {
 
 	// Add the db handle to the map.
 	c.dbByBaseDomain[bd] = db
+	c.fileByBaseDomain[bd] = filepath.Base(filename)
 
 	return db, nil
 }
 
 func (c *SqliteCache) findDB(bd string) (*sql.DB, error) {
-	// (Assumes the mutex is already locked)
+	// (Assumes we're already wlocked.)
 
 	filename, err := findSqliteFile(c.path, bd)
 	if err != nil {
@@ -286,11 +1370,107 @@ func (c *SqliteCache) findDB(bd string) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = initDB(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 	// Add the db handle to the map.
 	c.dbByBaseDomain[bd] = db
+	c.fileByBaseDomain[bd] = filepath.Base(filename)
 	return db, nil
 }
 
+// binFile returns the filename of the given base domain's open current bin.
+func (c *SqliteCache) binFile(bd string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.fileByBaseDomain[bd]
+}
+
+// getFileDB returns a handle to the given bin file. If it is the open
+// current bin, its handle is used, otherwise the bin is opened read-only,
+// and kept open until CloseAll.
+func (c *SqliteCache) getFileDB(filename string) (*fileDB, error) {
+	c.mu.RLock()
+	f, ok := c.dbByFile[filename]
+	if !ok {
+		bd, _, _ := parseBinName(filepath.Base(filename))
+		if c.fileByBaseDomain[bd] == filepath.Base(filename) {
+			f, ok = &fileDB{db: c.dbByBaseDomain[bd]}, true
+		}
+	}
+	c.mu.RUnlock()
+	if ok {
+		return f, nil
+	}
+
+	// Open it without holding the lock, then recheck.
+	f, err := openFileDB(filename)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if other, ok := c.dbByFile[filename]; ok {
+		// Must've come from another goroutine, inbetween the rlock and wlock.
+		f.db.Close()
+		return other, nil
+	}
+	c.dbByFile[filename] = f
+	return f, nil
+}
+
+// fileDB is a handle to a bin opened by filename. Old bins are read
+// as they were left, without upgrading their schema, so queries are
+// rewritten for any columns and tables they lack.
+type fileDB struct {
+	db *sql.DB
+	// missing are the upgrade columns the bin lacks.
+	missing []upgradeColumn
+	// noHistory is true if the bin has no history table.
+	noHistory bool
+}
+
+// openFileDB opens the given bin file read-only.
+func openFileDB(filename string) (*fileDB, error) {
+	db, err := sql.Open("sqlite3", "file:"+filename+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	f := &fileDB{db: db}
+	existing, err := columnNames(db)
+	if err == nil {
+		var n int
+		err = db.QueryRow(historyTableSQL).Scan(&n)
+		f.noHistory = n == 0
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, col := range upgradeColumns {
+		if !existing[col.name] {
+			f.missing = append(f.missing, col)
+		}
+	}
+	return f, nil
+}
+
+// query returns the given query, rewritten for the bin: missing columns
+// are selected as their default values, and a missing history table
+// is treated as empty.
+func (f *fileDB) query(query string) string {
+	for _, col := range f.missing {
+		re := regexp.MustCompile(`\b` + col.name + `\b`)
+		query = re.ReplaceAllLiteralString(query, col.value()+" AS "+col.name)
+	}
+	if f.noHistory {
+		query = strings.ReplaceAll(query, "FROM web_resource_history", "FROM (SELECT * FROM web_resource WHERE 0)")
+	}
+	return query
+}
+
 func findSqliteFile(path, bd string) (string, error) {
 
 	files, err := filterFiles(path, bd, fileExt)
@@ -298,15 +1478,19 @@ func findSqliteFile(path, bd string) (string, error) {
 		return "", err
 	}
 
-	if len(files) == 0 {
-		return "", nil
-	}
-
 	// for _, file := range files {
 	// 	fmt.Println(file)
 	// }
 
-	return files[len(files)-1], nil
+	// Files are sorted, so the last one is the newest.
+	// (The prefix also matches other domains, e.g. example.com.au)
+	for i := len(files) - 1; i >= 0; i-- {
+		name, _, ok := parseBinName(filepath.Base(files[i]))
+		if ok && name == bd {
+			return files[i], nil
+		}
+	}
+	return "", nil
 }
 
 func filterFiles(root, prefix, ext string) ([]string, error) {
@@ -315,24 +1499,23 @@ func filterFiles(root, prefix, ext string) ([]string, error) {
 		ext = "." + ext
 	}
 
-	var files []string
-
-	// We will filter files with the correct extension and name prefix.
-	filterFn := func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() || filepath.Ext(path) != ext || !strings.HasPrefix(info.Name(), prefix) {
-			return nil
+	// Only the folder itself is searched: subfolders hold namespaces.
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
 		}
-
-		files = append(files, path)
-		return nil
+		return nil, err
 	}
 
-	err := filepath.Walk(root, filterFn)
-	if err != nil {
-		return nil, err
+	// We will filter files with the correct extension and name prefix.
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || filepath.Ext(name) != ext || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		files = append(files, filepath.Join(root, name))
 	}
 
 	sort.Strings(files)
@@ -340,8 +1523,41 @@ func filterFiles(root, prefix, ext string) ([]string, error) {
 	return files, nil
 }
 
+// Bins are named with nanosecond resolution, so each
+// rotation gets its own bin. Older versions named bins
+// by the minute, and those names are still parsed.
+const (
+	timestampFormat       = "2006-01-02-150405.000000000"
+	legacyTimestampFormat = "2006-01-02-1504"
+)
+
 func timestamp() string {
-	return time.Now().UTC().Format("2006-01-02-1504")
+	return time.Now().UTC().Format(timestampFormat)
+}
+
+// parseBinName parses a bin's filename, of the form
+// "example.com-2006-01-02-150405.000000000.sqlite"
+// (or "example.com-2006-01-02-1504.sqlite"), returning its
+// key (by default, a base domain) and creation time.
+// (Names sort by time, even when both forms are mixed,
+// as an older name sorts before a newer one of its minute.)
+func parseBinName(name string) (string, time.Time, bool) {
+	name, ok := strings.CutSuffix(name, fileExt)
+	if !ok {
+		return "", time.Time{}, false
+	}
+	for _, layout := range []string{timestampFormat, legacyTimestampFormat} {
+		i := len(name) - len(layout)
+		if i < 2 || name[i-1] != '-' {
+			continue
+		}
+		created, err := time.Parse(layout, name[i:])
+		if err != nil {
+			continue
+		}
+		return name[:i-1], created, true
+	}
+	return "", time.Time{}, false
 }
 
 func createDB(filename string) (*sql.DB, error) {
@@ -351,16 +1567,61 @@ func createDB(filename string) (*sql.DB, error) {
 	}
 
 	// Run db init DDL/scripts.
+	err = initDB(db)
+	if err != nil {
+		return nil, err
+	}
+
+	// log.Printf("created db %s", filename)
+
+	return db, nil
+}
+
+// initDB creates any tables missing from the db, and adds any columns
+// missing from a db created by an earlier version.
+func initDB(db *sql.DB) error {
 	for _, ddl := range createDDL {
-		_, err = db.Exec(ddl)
+		_, err := db.Exec(ddl)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	// log.Printf("created db %s", filename)
+	existing, err := columnNames(db)
+	if err != nil {
+		return err
+	}
+	for _, col := range upgradeColumns {
+		if existing[col.name] {
+			continue
+		}
+		_, err = db.Exec("ALTER TABLE web_resource ADD COLUMN " + col.name + " " + col.def)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return db, nil
+// columnNames returns the names of web_resource's columns.
+func columnNames(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query("PRAGMA table_info(web_resource)")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		err = rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk)
+		if err != nil {
+			return nil, err
+		}
+		existing[name] = true
+	}
+	return existing, rows.Err()
 }
 
 var createDDL = []string{`
@@ -383,13 +1644,138 @@ var createDDL = []string{`
 		PRIMARY KEY (normalised_url, content_language, content_type)
 	)`, // TODO(js) Should etag and last_modified have be nullable?
 	"CREATE INDEX IF NOT EXISTS idx_web_resource_url ON web_resource(url)",
-	"CREATE INDEX IF NOT EXISTS idx_web_resource_created_at ON web_resource(created_at)",
+	"CREATE INDEX IF NOT EXISTS idx_web_resource_created_at ON web_resource(created_at)", `
+	CREATE TABLE IF NOT EXISTS web_resource_history (
+		normalised_url		TEXT NOT NULL,
+		url					TEXT NOT NULL,
+		base_domain			TEXT NOT NULL,
+		status              INTEGER NOT NULL,
+		protocol			TEXT NOT NULL,
+		content_language	TEXT NOT NULL,
+		content_type		TEXT NOT NULL,
+		etag				TEXT NOT NULL,
+		last_modified		TEXT NOT NULL,
+		content				BLOB,
+		compressed_size		INTEGER NOT NULL,
+		content_length		INTEGER NOT NULL,
+		response_ms			REAL NOT NULL,
+		md5					TEXT NOT NULL,
+		created_at			DATETIME NOT NULL,
+		location			TEXT NOT NULL,
+		content_ref			TEXT NOT NULL,
+		archived_at			DATETIME NOT NULL,
+		PRIMARY KEY (normalised_url, content_language, content_type, created_at)
+	)`, `
+	CREATE TABLE IF NOT EXISTS web_resource_chunk (
+		content_ref			TEXT NOT NULL,
+		seq					INTEGER NOT NULL,
+		data				BLOB NOT NULL,
+		PRIMARY KEY (content_ref, seq)
+	)`,
+}
+
+type upgradeColumn struct {
+	name string
+	def  string
 }
 
-const querySQL = "SELECT * FROM web_resource WHERE normalised_url = ?"
+// value returns the column's default value, as an SQL expression.
+func (col upgradeColumn) value() string {
+	_, v, ok := strings.Cut(col.def, "DEFAULT ")
+	if !ok {
+		return "NULL"
+	}
+	return v
+}
+
+// upgradeColumns are columns added to web_resource after its initial release,
+// in the order they were added. Columns missing from older dbs get added on open.
+var upgradeColumns = []upgradeColumn{
+	{"location", "TEXT NOT NULL DEFAULT ''"},
+	{"content_ref", "TEXT NOT NULL DEFAULT ''"},
+	{"last_accessed_at", "DATETIME"},
+	{"hit_count", "INTEGER NOT NULL DEFAULT 0"},
+	{"imported_at", "DATETIME"},
+}
+
+const recordColumns = "normalised_url, url, base_domain, status, protocol, content_language, content_type, etag, last_modified, content, compressed_size, content_length, response_ms, md5, created_at, location, content_ref"
+
+const historyTableSQL = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'web_resource_history'"
+
+const querySQL = "SELECT " + recordColumns + ", last_accessed_at, hit_count, imported_at FROM web_resource WHERE normalised_url = ?"
+
+// queryAsOfSQL selects the newest record created by a given time,
+// from either the current records, or their history.
+const queryAsOfSQL = "SELECT " + recordColumns + ", last_accessed_at, hit_count, imported_at FROM web_resource WHERE normalised_url = ? AND created_at <= ?" +
+	" UNION ALL SELECT " + recordColumns + ", NULL, 0, NULL FROM web_resource_history WHERE normalised_url = ? AND created_at <= ?" +
+	" ORDER BY created_at DESC LIMIT 1"
+
+// versionsSQL selects all records, from both
+// the current records and their history, newest first.
+const versionsSQL = "SELECT " + recordColumns + ", last_accessed_at, hit_count, imported_at FROM web_resource WHERE normalised_url = ?" +
+	" UNION ALL SELECT " + recordColumns + ", NULL, 0, NULL FROM web_resource_history WHERE normalised_url = ?" +
+	" ORDER BY created_at DESC"
+
+// variantVersionsSQL selects all records of a variant, from
+// both the current records and their history, newest first.
+const variantVersionsSQL = "SELECT " + recordColumns + ", last_accessed_at, hit_count, imported_at FROM web_resource WHERE normalised_url = ? AND content_language = ? AND content_type = ?" +
+	" UNION ALL SELECT " + recordColumns + ", NULL, 0, NULL FROM web_resource_history WHERE normalised_url = ? AND content_language = ? AND content_type = ?" +
+	" ORDER BY created_at DESC"
+
+// queryLatestSQL selects the newest record, from either
+// the current records, or their history.
+const queryLatestSQL = versionsSQL + " LIMIT 1"
+
+const archiveSQL = "INSERT OR IGNORE INTO web_resource_history (" + recordColumns + ", archived_at) SELECT " + recordColumns + ", ? FROM web_resource WHERE normalised_url = ?"
+
+// queryHistorySQL selects the newest record from the history.
+const queryHistorySQL = "SELECT " + recordColumns + ", NULL, 0, NULL FROM web_resource_history WHERE normalised_url = ? ORDER BY created_at DESC LIMIT 1"
+
+const queryBodySQL = "SELECT content, content_ref FROM web_resource WHERE normalised_url = ? AND content_language = ? AND content_type = ?"
+
+const touchSQL = "UPDATE web_resource SET last_accessed_at = ?, hit_count = hit_count + 1 WHERE normalised_url = ? AND content_language = ? AND content_type = ?"
 
 // TODO(js) Review/document this decision (replace vs ignore)
-const insertSQL = "INSERT OR IGNORE INTO web_resource (normalised_url, url, base_domain, status, protocol, content_language, content_type, etag, last_modified, content, compressed_size, content_length, response_ms, md5, created_at) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
+const insertSQL = "INSERT OR IGNORE INTO web_resource (" + recordColumns + ", imported_at) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
+
+const walkSQL = "SELECT normalised_url, url, base_domain, status, protocol, content_language, content_type, etag, last_modified, compressed_size, content_length, response_ms, md5, created_at, location, last_accessed_at, hit_count, imported_at FROM web_resource ORDER BY normalised_url"
+
+const archiveExpiredSQL = "INSERT OR IGNORE INTO web_resource_history (" + recordColumns + ", archived_at) SELECT " + recordColumns + ", ? FROM web_resource WHERE COALESCE(imported_at, created_at) < ?"
+
+const deleteExpiredChunksSQL = "DELETE FROM web_resource_chunk WHERE content_ref IN (SELECT content_ref FROM web_resource WHERE COALESCE(imported_at, created_at) < ? AND content_ref != '')"
+
+const deleteExpiredSQL = "DELETE FROM web_resource WHERE COALESCE(imported_at, created_at) < ?"
+
+// usedSQL selects the compressed size of the records and their history.
+const usedSQL = "SELECT (SELECT COALESCE(SUM(compressed_size), 0) FROM web_resource) + (SELECT COALESCE(SUM(compressed_size), 0) FROM web_resource_history)"
+
+// lruSQL selects the records and their history, least recently used
+// first. History is taken as last used when it was archived.
+const lruSQL = "SELECT 0, rowid, compressed_size, COALESCE(last_accessed_at, created_at) AS accessed FROM web_resource" +
+	" UNION ALL SELECT 1, rowid, compressed_size, archived_at FROM web_resource_history" +
+	" ORDER BY accessed"
+
+const deleteLRUChunksSQL = "DELETE FROM web_resource_chunk WHERE content_ref IN (SELECT content_ref FROM web_resource WHERE rowid = ? AND content_ref != '')"
+
+const deleteLRUSQL = "DELETE FROM web_resource WHERE rowid = ?"
+
+const deleteLRUHistoryChunksSQL = "DELETE FROM web_resource_chunk WHERE content_ref IN (SELECT content_ref FROM web_resource_history WHERE rowid = ? AND content_ref != '')"
+
+const deleteLRUHistorySQL = "DELETE FROM web_resource_history WHERE rowid = ?"
+
+const keysSQL = "SELECT DISTINCT normalised_url FROM web_resource"
+
+const statsSQL = "SELECT COUNT(*), COALESCE(SUM(content_length), 0), COALESCE(SUM(compressed_size), 0) FROM web_resource"
+
+const refreshSQL = "UPDATE web_resource SET created_at = ?, etag = ?, last_modified = ?, imported_at = NULL WHERE normalised_url = ? AND content_language = ? AND content_type = ?"
+
+const deleteSQL = "DELETE FROM web_resource WHERE normalised_url = ?"
+
+const deleteChunksSQL = "DELETE FROM web_resource_chunk WHERE content_ref IN (SELECT content_ref FROM web_resource WHERE normalised_url = ? AND content_ref != '')"
+
+const queryChunkSQL = "SELECT data FROM web_resource_chunk WHERE content_ref = ? AND seq = ?"
+
+const insertChunkSQL = "INSERT INTO web_resource_chunk (content_ref, seq, data) VALUES (?,?,?)"
 
 // const insertSQL = "INSERT INTO web_resource (normalised_url, url, base_domain, content_language, content_type, etag, last_modified, content, compressed_size, content_length, response_ms, md5, created_at) VALUES  (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
 // const insertSQL = "INSERT OR REPLACE INTO web_resource (normalised_url, url, base_domain, status, protocol, content_language, content_type, etag, last_modified, content, compressed_size, content_length, response_ms, md5, created_at) VALUES  (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
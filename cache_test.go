@@ -1,13 +1,22 @@
 package progszy_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"io"
+	"math/rand"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jimsmart/progszy"
+	"github.com/valyala/gozstd"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -69,6 +78,68 @@ var _ = Describe("Cache", func() {
 			Expect(d).To(Equal("example.co.uk"))
 		})
 
+		It("should parse rate limits", func() {
+			for s, want := range map[string]float64{
+				"2":    2,
+				"0.5":  0.5,
+				"2/s":  2,
+				"30/m": 0.5,
+				"1/5s": 0.2,
+				"0":    0,
+			} {
+				r, err := progszy.ParseRate(s)
+				Expect(err).To(BeNil())
+				Expect(r).To(BeNumerically("~", want, 1e-9))
+			}
+			_, err := progszy.ParseRate("1/x")
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("should parse TTLs", func() {
+			for s, want := range map[string]time.Duration{
+				"":    0,
+				"24h": 24 * time.Hour,
+				"90":  90 * time.Second,
+			} {
+				d, err := progszy.ParseTTL(s)
+				Expect(err).To(BeNil())
+				Expect(d).To(Equal(want))
+			}
+			_, err := progszy.ParseTTL("-1h")
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("should parse max backoffs", func() {
+			for s, want := range map[string]time.Duration{
+				"":    5 * time.Minute,
+				"10m": 10 * time.Minute,
+				"90":  90 * time.Second,
+			} {
+				d, err := progszy.ParseMaxBackoff(s)
+				Expect(err).To(BeNil())
+				Expect(d).To(Equal(want))
+			}
+			_, err := progszy.ParseMaxBackoff("0s")
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("should parse sizes", func() {
+			for s, want := range map[string]int64{
+				"":       0,
+				"1024":   1024,
+				"500MB":  500e6,
+				"20 GB":  20e9,
+				"1.5GiB": 1.5 * (1 << 30),
+				"10k":    10e3,
+			} {
+				n, err := progszy.ParseSize(s)
+				Expect(err).To(BeNil())
+				Expect(n).To(Equal(want))
+			}
+			_, err := progszy.ParseSize("10 parsecs")
+			Expect(err).ToNot(BeNil())
+		})
+
 		It("should return the host for foo.www.example.co.uk", func() {
 			u, _ := url.Parse("http://foo.www.example.co.uk/")
 			d, err := progszy.BaseDomainName(u)
@@ -76,6 +147,46 @@ var _ = Describe("Cache", func() {
 			Expect(d).To(Equal("example.co.uk"))
 		})
 
+		It("should bin URLs by strategy", func() {
+			u, _ := url.Parse("http://API.example.co.uk:8080/a")
+			for strategy, want := range map[string]string{
+				"root":      "example.co.uk",
+				"fqdn":      "api.example.co.uk",
+				"host-port": "api.example.co.uk_8080",
+			} {
+				b, err := progszy.NewBinner(strategy, nil)
+				Expect(err).To(BeNil())
+				bin, err := b.Bin(u)
+				Expect(err).To(BeNil())
+				Expect(bin).To(Equal(want))
+			}
+			_, err := progszy.NewBinner("nope", nil)
+			Expect(err).ToNot(BeNil())
+			_, err = progszy.NewBinner("regex", nil)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("should bin URLs by regex rules", func() {
+			b, err := progszy.NewBinner("regex", []progszy.BinRule{
+				{Match: `^https?://([a-z]+)\.example\.com/blog/`, Bin: "$1-blog"},
+				{Match: `^https?://[^/]*example\.(com|org)/`, Bin: "example"},
+			})
+			Expect(err).To(BeNil())
+			for uri, want := range map[string]string{
+				"http://www.example.com/blog/post": "www-blog",
+				"http://www.example.com/about":     "example",
+				"https://example.org/":             "example",
+				"http://api.example.net/":          "example.net",
+			} {
+				u, _ := url.Parse(uri)
+				bin, err := b.Bin(u)
+				Expect(err).To(BeNil())
+				Expect(bin).To(Equal(want))
+			}
+			_, err = progszy.NewBinner("regex", []progszy.BinRule{{Match: "(", Bin: "x"}})
+			Expect(err).ToNot(BeNil())
+		})
+
 	})
 
 	// Describe("MemCache methods", func() {
@@ -146,6 +257,773 @@ var _ = Describe("Cache", func() {
 			Expect(err).To(BeNil())
 		})
 
+		It("should store large bodies in chunks and get them out again", func() {
+
+			// Random content doesn't compress, so will need several chunks.
+			content := randomContent(3 * 1024 * 1024)
+
+			c := progszy.NewSqliteCache(testCachePath)
+			cr, err := progszy.NewCacheRecord("http://example.com/large", 200, "", "", "application/octet-stream", "", "", content, 0, time.Now())
+			Expect(err).To(BeNil())
+			err = c.Put(cr)
+			Expect(err).To(BeNil())
+			cr, err = c.Get("http://example.com/large")
+			Expect(err).To(BeNil())
+			Expect(cr.ZstdBody).To(BeNil())
+			Expect(cr.ContentLength).To(Equal(int64(len(content))))
+			r, err := cr.Body()
+			Expect(err).To(BeNil())
+			defer r.Close()
+			b, err := io.ReadAll(r)
+			Expect(err).To(BeNil())
+			Expect(b).To(Equal(content))
+			err = c.CloseAll()
+			Expect(err).To(BeNil())
+		})
+
+		It("should stream the same body as a whole body decompression", func() {
+
+			inline := bytes.Repeat([]byte("fake-content "), 10000)
+			// Random content doesn't compress, so will need several chunks.
+			chunked := randomContent(3 * 1024 * 1024)
+
+			c := progszy.NewSqliteCache(testCachePath)
+			for uri, content := range map[string][]byte{
+				"http://example.com/inline":  inline,
+				"http://example.com/chunked": chunked,
+			} {
+				cr, err := progszy.NewCacheRecord(uri, 200, "", "", "text/plain", "", "", content, 0, time.Now())
+				Expect(err).To(BeNil())
+				want, err := gozstd.Decompress(nil, cr.ZstdBody)
+				Expect(err).To(BeNil())
+				Expect(want).To(Equal(content))
+				err = c.Put(cr)
+				Expect(err).To(BeNil())
+
+				cr, err = c.Get(uri)
+				Expect(err).To(BeNil())
+				if uri == "http://example.com/inline" {
+					Expect(cr.ZstdBody).ToNot(BeNil())
+				} else {
+					Expect(cr.ZstdBody).To(BeNil())
+				}
+				r, err := cr.Body()
+				Expect(err).To(BeNil())
+				// Read in small, odd sized pieces.
+				var got []byte
+				buf := make([]byte, 4093)
+				for {
+					n, err := r.Read(buf)
+					got = append(got, buf[:n]...)
+					if err == io.EOF {
+						break
+					}
+					Expect(err).To(BeNil())
+				}
+				Expect(r.Close()).To(BeNil())
+				Expect(got).To(Equal(want))
+			}
+			err := c.CloseAll()
+			Expect(err).To(BeNil())
+		})
+
+		It("should track hits and evict the least recently used records", func() {
+
+			c := progszy.NewSqliteCache(testCachePath)
+			put := func(uri string, age time.Duration) {
+				// Random content doesn't compress, so is ~1mb stored.
+				cr, err := progszy.NewCacheRecord(uri, 200, "", "", "text/html", "", "", randomContent(1000*1000), 0, time.Now().Add(-age))
+				Expect(err).To(BeNil())
+				err = c.Put(cr)
+				Expect(err).To(BeNil())
+			}
+			put("http://example.com/3", 3*time.Hour)
+			put("http://example.com/2", 2*time.Hour)
+			put("http://example.com/1", time.Hour)
+			put("http://example.org/1", 30*time.Minute)
+
+			cr, err := c.Get("http://example.com/3")
+			Expect(err).To(BeNil())
+			Expect(cr.HitCount).To(BeNumerically("==", 1))
+			cr, err = c.Get("http://example.com/3")
+			Expect(err).To(BeNil())
+			Expect(cr.HitCount).To(BeNumerically("==", 2))
+			Expect(time.Since(cr.LastAccessed)).To(BeNumerically("<", time.Minute))
+
+			quota := func(bd string) int64 {
+				if bd == "example.com" {
+					return 2500 * 1000
+				}
+				return 0
+			}
+			n, err := c.Trim(quota, 0)
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(1))
+			_, err = c.Get("http://example.com/2")
+			Expect(err).To(Equal(progszy.ErrCacheMiss))
+
+			// Most recently used are now example.com/3, then example.org/1.
+			n, err = c.Trim(quota, 2500*1000)
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(1))
+			_, err = c.Get("http://example.com/1")
+			Expect(err).To(Equal(progszy.ErrCacheMiss))
+			_, err = c.Get("http://example.com/3")
+			Expect(err).To(BeNil())
+			_, err = c.Get("http://example.org/1")
+			Expect(err).To(BeNil())
+
+			err = c.CloseAll()
+			Expect(err).To(BeNil())
+		})
+
+		It("should count history, old bins and namespaces against quotas", func() {
+
+			c := progszy.NewSqliteCache(testCachePath)
+			defer c.CloseAll()
+			put := func(c progszy.Cache, uri string, keep bool) {
+				// Random content doesn't compress, so is ~1mb stored.
+				cr, err := progszy.NewCacheRecord(uri, 200, "", "", "text/html", "", "", randomContent(1000*1000), 0, time.Now())
+				Expect(err).To(BeNil())
+				err = c.Replace(cr, keep)
+				Expect(err).To(BeNil())
+			}
+			put(c, "http://example.com/1", false)
+			err := c.Rotate("example.com")
+			Expect(err).To(BeNil())
+			put(c, "http://example.com/2", false)
+			put(c, "http://example.com/2", true)
+			ns, err := c.Namespace("alpha")
+			Expect(err).To(BeNil())
+			put(ns, "http://example.com/3", false)
+
+			// Each namespace's bins are within a 3.5mb total, but not all together.
+			// So the old bin goes first, then the history of example.com/2.
+			none := func(bd string) int64 { return 0 }
+			n, err := c.Trim(none, 2500*1000)
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(1))
+			bins, err := c.Bins()
+			Expect(err).To(BeNil())
+			Expect(bins).To(HaveLen(1))
+			vs, err := c.Versions("http://example.com/2")
+			Expect(err).To(BeNil())
+			Expect(vs).To(HaveLen(1))
+			_, err = ns.Get("http://example.com/3")
+			Expect(err).To(BeNil())
+
+			// A domain quota applies within each namespace.
+			quota := func(bd string) int64 { return 500 * 1000 }
+			n, err = c.Trim(quota, 0)
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(2))
+			_, err = c.Get("http://example.com/2")
+			Expect(err).To(Equal(progszy.ErrCacheMiss))
+			_, err = ns.Get("http://example.com/3")
+			Expect(err).To(Equal(progszy.ErrCacheMiss))
+		})
+
+		It("should expire old records", func() {
+
+			c := progszy.NewSqliteCache(testCachePath)
+			for _, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, 0} {
+				uri := fmt.Sprintf("http://example.com/%d", age/time.Hour)
+				cr, err := progszy.NewCacheRecord(uri, 200, "", "", "text/html", "", "", randomContent(2*1024*1024), 0, time.Now().Add(-age))
+				Expect(err).To(BeNil())
+				err = c.Put(cr)
+				Expect(err).To(BeNil())
+			}
+
+			n, err := c.Expire("example.com", time.Now().Add(-150*time.Minute), false)
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(1))
+			n, err = c.Expire("example.com", time.Now().Add(-time.Hour), true)
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(1))
+
+			_, err = c.Get("http://example.com/3")
+			Expect(err).To(Equal(progszy.ErrCacheMiss))
+			_, err = c.Get("http://example.com/2")
+			Expect(err).To(Equal(progszy.ErrCacheMiss))
+			_, err = c.Get("http://example.com/0")
+			Expect(err).To(BeNil())
+
+			// Archived records are previous copies, deleted ones are gone.
+			cr, err := c.GetPrevious("http://example.com/2")
+			Expect(err).To(BeNil())
+			Expect(cr.ContentLength).To(BeNumerically("==", 2*1024*1024))
+			_, err = c.GetPrevious("http://example.com/3")
+			Expect(err).To(Equal(progszy.ErrCacheMiss))
+			err = c.CloseAll()
+			Expect(err).To(BeNil())
+		})
+
+		It("should get records as of a given time", func() {
+
+			c := progszy.NewSqliteCache(testCachePath)
+			old := time.Date(2020, 1, 1, 0, 10, 0, 0, time.UTC)
+			cr, err := progszy.NewCacheRecord("http://example.com/", 200, "", "", "text/plain", "", "", []byte("v1"), 0, old)
+			Expect(err).To(BeNil())
+			err = c.Put(cr)
+			Expect(err).To(BeNil())
+			err = c.CloseAll()
+			Expect(err).To(BeNil())
+
+			// Make it an old bin, then start a new one.
+			matches, err := filepath.Glob(filepath.Join(testCachePath, "example.com-*.sqlite"))
+			Expect(err).To(BeNil())
+			Expect(matches).To(HaveLen(1))
+			err = os.Rename(matches[0], filepath.Join(testCachePath, "example.com-2020-01-01-0000.sqlite"))
+			Expect(err).To(BeNil())
+			c = progszy.NewSqliteCache(testCachePath)
+			err = c.Rotate("example.com")
+			Expect(err).To(BeNil())
+			cr, err = progszy.NewCacheRecord("http://example.com/", 200, "", "", "text/plain", "", "", []byte("v2"), 0, time.Now())
+			Expect(err).To(BeNil())
+			err = c.Put(cr)
+			Expect(err).To(BeNil())
+			current := cr.Bin
+			Expect(current).ToNot(Equal("example.com-2020-01-01-0000.sqlite"))
+
+			body := func(asOf time.Time) (string, string) {
+				cr, err := c.GetAsOf("http://example.com/", asOf)
+				Expect(err).To(BeNil())
+				r, err := cr.Body()
+				Expect(err).To(BeNil())
+				defer r.Close()
+				b, err := io.ReadAll(r)
+				Expect(err).To(BeNil())
+				return string(b), cr.Bin
+			}
+			b, bin := body(time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+			Expect(b).To(Equal("v1"))
+			Expect(bin).To(Equal("example.com-2020-01-01-0000.sqlite"))
+			b, bin = body(time.Now().Add(time.Minute))
+			Expect(b).To(Equal("v2"))
+			Expect(bin).To(Equal(current))
+
+			// Just before the current bin was created, the old bin was still current.
+			binCreated, err := time.Parse("2006-01-02-150405.000000000", strings.TrimSuffix(strings.TrimPrefix(current, "example.com-"), ".sqlite"))
+			Expect(err).To(BeNil())
+			b, bin = body(binCreated.Add(-time.Nanosecond))
+			Expect(b).To(Equal("v1"))
+			Expect(bin).To(Equal("example.com-2020-01-01-0000.sqlite"))
+
+			// Before the first bin, and before the first record.
+			_, err = c.GetAsOf("http://example.com/", time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC))
+			Expect(err).To(Equal(progszy.ErrCacheMiss))
+			_, err = c.GetAsOf("http://example.com/", time.Date(2020, 1, 1, 0, 5, 0, 0, time.UTC))
+			Expect(err).To(Equal(progszy.ErrCacheMiss))
+			err = c.CloseAll()
+			Expect(err).To(BeNil())
+		})
+
+		It("should start a new bin on each rotation, without closing the old one", func() {
+
+			c := progszy.NewSqliteCache(testCachePath)
+			defer c.CloseAll()
+			// A bin named by an older version, by the minute, is still used.
+			old := filepath.Join(testCachePath, "example.com-2020-01-01-0000.sqlite")
+			err := os.MkdirAll(testCachePath, 0755)
+			Expect(err).To(BeNil())
+			err = os.WriteFile(old, nil, 0644)
+			Expect(err).To(BeNil())
+
+			cr, err := progszy.NewCacheRecord("http://example.com/", 200, "", "", "text/plain", "", "", []byte("v1"), 0, time.Now())
+			Expect(err).To(BeNil())
+			err = c.Put(cr)
+			Expect(err).To(BeNil())
+			Expect(cr.Bin).To(Equal("example.com-2020-01-01-0000.sqlite"))
+
+			// Rotating while a bin is in use leaves its handle open.
+			n := 0
+			err = c.Walk(cr.Bin, func(cr *progszy.CacheRecord) error {
+				n++
+				for i := 0; i < 2; i++ {
+					err := c.Rotate("example.com")
+					if err != nil {
+						return err
+					}
+				}
+				r, err := cr.Body()
+				if err != nil {
+					return err
+				}
+				defer r.Close()
+				_, err = io.ReadAll(r)
+				return err
+			})
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(1))
+
+			bins, err := c.Bins()
+			Expect(err).To(BeNil())
+			Expect(bins).To(HaveLen(3))
+			Expect(bins[0].Created).To(Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)))
+			Expect(bins[1].Created.After(bins[0].Created)).To(BeTrue())
+			Expect(bins[2].Created.After(bins[1].Created)).To(BeTrue())
+			Expect(bins[2].Current).To(BeTrue())
+		})
+
+		It("should read old bins from earlier versions as they are", func() {
+
+			// A bin with the original schema, before any upgrades.
+			err := os.MkdirAll(testCachePath, 0755)
+			Expect(err).To(BeNil())
+			old := filepath.Join(testCachePath, "example.com-2020-01-01-0000.sqlite")
+			db, err := sql.Open("sqlite3", old)
+			Expect(err).To(BeNil())
+			_, err = db.Exec(`CREATE TABLE web_resource (
+				normalised_url TEXT NOT NULL, url TEXT NOT NULL, base_domain TEXT NOT NULL,
+				status INTEGER NOT NULL, protocol TEXT NOT NULL, content_language TEXT NOT NULL,
+				content_type TEXT NOT NULL, etag TEXT NOT NULL, last_modified TEXT NOT NULL,
+				content BLOB, compressed_size INTEGER NOT NULL, content_length INTEGER NOT NULL,
+				response_ms REAL NOT NULL, md5 TEXT NOT NULL, created_at DATETIME NOT NULL,
+				PRIMARY KEY (normalised_url, content_language, content_type))`)
+			Expect(err).To(BeNil())
+			z := gozstd.Compress(nil, []byte("v0"))
+			created := time.Date(2020, 1, 1, 0, 10, 0, 0, time.UTC)
+			_, err = db.Exec("INSERT INTO web_resource VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+				"http://example.com/", "http://example.com/", "example.com", 200, "HTTP/1.1", "", "text/plain", "", "", z, len(z), 2, 0, "", created)
+			Expect(err).To(BeNil())
+			err = db.Close()
+			Expect(err).To(BeNil())
+
+			c := progszy.NewSqliteCache(testCachePath)
+			defer c.CloseAll()
+			err = c.Rotate("example.com")
+			Expect(err).To(BeNil())
+
+			body := func(cr *progszy.CacheRecord) string {
+				r, err := cr.Body()
+				Expect(err).To(BeNil())
+				defer r.Close()
+				b, err := io.ReadAll(r)
+				Expect(err).To(BeNil())
+				return string(b)
+			}
+			cr, err := c.GetAsOf("http://example.com/", time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+			Expect(err).To(BeNil())
+			Expect(cr.Bin).To(Equal("example.com-2020-01-01-0000.sqlite"))
+			Expect(body(cr)).To(Equal("v0"))
+			cr, err = c.GetPrevious("http://example.com/")
+			Expect(err).To(BeNil())
+			Expect(body(cr)).To(Equal("v0"))
+			n := 0
+			err = c.Walk("example.com-2020-01-01-0000.sqlite", func(cr *progszy.CacheRecord) error {
+				n++
+				Expect(body(cr)).To(Equal("v0"))
+				return nil
+			})
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(1))
+
+			// Its schema is left unchanged.
+			db, err = sql.Open("sqlite3", old)
+			Expect(err).To(BeNil())
+			defer db.Close()
+			var tables, columns int
+			err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables)
+			Expect(err).To(BeNil())
+			Expect(tables).To(Equal(1))
+			err = db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('web_resource')").Scan(&columns)
+			Expect(err).To(BeNil())
+			Expect(columns).To(Equal(15))
+		})
+
+		It("should find existing bins from concurrent goroutines", func() {
+
+			c := progszy.NewSqliteCacheWithBinner(testCachePath, progszy.FQDNBinner)
+			var uris []string
+			for i := 0; i < 20; i++ {
+				uri := fmt.Sprintf("http://host%d.example.com/", i)
+				uris = append(uris, uri)
+				cr, err := progszy.NewCacheRecord(uri, 200, "", "", "text/plain", "", "", []byte(uri), 0, time.Now())
+				Expect(err).To(BeNil())
+				err = c.Put(cr)
+				Expect(err).To(BeNil())
+			}
+			err := c.CloseAll()
+			Expect(err).To(BeNil())
+
+			// A new cache opens each bin on its first lookup.
+			c = progszy.NewSqliteCacheWithBinner(testCachePath, progszy.FQDNBinner)
+			var wg sync.WaitGroup
+			errs := make(chan error, 4*len(uris))
+			for i := 0; i < 4; i++ {
+				for _, uri := range uris {
+					wg.Add(1)
+					go func(uri string) {
+						defer wg.Done()
+						_, err := c.Get(uri)
+						errs <- err
+					}(uri)
+				}
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				Expect(err).To(BeNil())
+			}
+			err = c.CloseAll()
+			Expect(err).To(BeNil())
+		})
+
+		It("should use separate bins per host when binning by FQDN", func() {
+
+			c := progszy.NewSqliteCacheWithBinner(testCachePath, progszy.FQDNBinner)
+			uris := []string{"http://example.com/", "http://www.example.com/", "http://api.example.com/", "http://example.com.au/"}
+			for _, uri := range uris {
+				cr, err := progszy.NewCacheRecord(uri, 200, "", "", "text/plain", "", "", []byte(uri), 0, time.Now())
+				Expect(err).To(BeNil())
+				err = c.Put(cr)
+				Expect(err).To(BeNil())
+			}
+			err := c.CloseAll()
+			Expect(err).To(BeNil())
+
+			// Existing bins are found again by a new cache.
+			c = progszy.NewSqliteCacheWithBinner(testCachePath, progszy.FQDNBinner)
+			for _, uri := range uris {
+				cr, err := c.Get(uri)
+				Expect(err).To(BeNil())
+				r, err := cr.Body()
+				Expect(err).To(BeNil())
+				b, err := io.ReadAll(r)
+				r.Close()
+				Expect(err).To(BeNil())
+				Expect(string(b)).To(Equal(uri))
+			}
+			bins, err := c.Bins()
+			Expect(err).To(BeNil())
+			var keys []string
+			for _, b := range bins {
+				keys = append(keys, b.BaseDomain)
+			}
+			Expect(keys).To(Equal([]string{"api.example.com", "example.com", "example.com.au", "www.example.com"}))
+
+			// Binning by root domain does not see the FQDN bins.
+			err = c.CloseAll()
+			Expect(err).To(BeNil())
+			c = progszy.NewSqliteCache(testCachePath)
+			_, err = c.Get("http://www.example.com/")
+			Expect(err).To(Equal(progszy.ErrCacheMiss))
+			_, err = c.Get("http://example.com/")
+			Expect(err).To(BeNil())
+			err = c.CloseAll()
+			Expect(err).To(BeNil())
+		})
+
+		Describe("importing and exporting", func() {
+
+			var c *progszy.SqliteCache
+			var created time.Time
+			var bins []progszy.BinInfo
+
+			BeforeEach(func() {
+				c = progszy.NewSqliteCache(testCachePath)
+				created = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+				cr, err := progszy.NewCacheRecord("http://example.com/", 200, "HTTP/1.1", "en", "text/html", `"abc"`, "", []byte("fake-content"), 0, created)
+				Expect(err).To(BeNil())
+				err = c.Put(cr)
+				Expect(err).To(BeNil())
+				bins, err = c.Bins()
+				Expect(err).To(BeNil())
+				Expect(bins).To(HaveLen(1))
+			})
+
+			AfterEach(func() {
+				err := c.CloseAll()
+				Expect(err).To(BeNil())
+				err = os.RemoveAll(filepath.Join(testCachePath, "import"))
+				Expect(err).To(BeNil())
+			})
+
+			It("should export a bin as WARC records", func() {
+
+				for _, compression := range []string{progszy.WARCUncompressed, progszy.WARCGzip, progszy.WARCZstd} {
+					var buf bytes.Buffer
+					err := progszy.ExportWARC(&buf, c, bins[0].Name, compression)
+					Expect(err).To(BeNil())
+					var r io.Reader = &buf
+					switch compression {
+					case progszy.WARCGzip:
+						r, err = gzip.NewReader(r)
+						Expect(err).To(BeNil())
+					case progszy.WARCZstd:
+						zr := gozstd.NewReader(r)
+						defer zr.Release()
+						r = zr
+					}
+					b, err := io.ReadAll(r)
+					Expect(err).To(BeNil())
+					records := strings.Split(string(b), "\r\n\r\nWARC/1.1\r\n")
+					Expect(records).To(HaveLen(2))
+					Expect(records[0]).To(ContainSubstring("WARC-Type: warcinfo\r\n"))
+					Expect(records[1]).To(ContainSubstring("WARC-Type: response\r\n"))
+					Expect(records[1]).To(ContainSubstring("WARC-Target-URI: http://example.com/\r\n"))
+					Expect(records[1]).To(ContainSubstring("WARC-Date: 2020-01-01T12:00:00Z\r\n"))
+					head := "HTTP/1.1 200 OK\r\n" +
+						"Content-Type: text/html\r\n" +
+						"Content-Language: en\r\n" +
+						"ETag: \"abc\"\r\n" +
+						"Content-Length: 12\r\n" +
+						"\r\n"
+					Expect(records[1]).To(ContainSubstring(fmt.Sprintf("Content-Length: %d\r\n\r\n%sfake-content\r\n\r\n", len(head)+12, head)))
+				}
+
+			})
+
+			It("should import WARC response records", func() {
+
+				for _, compression := range []string{progszy.WARCUncompressed, progszy.WARCGzip, progszy.WARCZstd} {
+					var buf bytes.Buffer
+					err := progszy.ExportWARC(&buf, c, bins[0].Name, compression)
+					Expect(err).To(BeNil())
+
+					ns, err := c.Namespace("import")
+					Expect(err).To(BeNil())
+					n, err := progszy.ImportWARC(&buf, ns)
+					Expect(err).To(BeNil())
+					Expect(n).To(Equal(1))
+					cr, err := ns.Get("http://example.com/")
+					Expect(err).To(BeNil())
+					Expect(cr.Created).To(Equal(created))
+					Expect(cr.Status).To(Equal(200))
+					Expect(cr.Protocol).To(Equal("HTTP/1.1"))
+					Expect(cr.ContentLanguage).To(Equal("en"))
+					Expect(cr.ContentType).To(Equal("text/html"))
+					Expect(cr.ETag).To(Equal(`"abc"`))
+					r, err := cr.Body()
+					Expect(err).To(BeNil())
+					b, err := io.ReadAll(r)
+					r.Close()
+					Expect(err).To(BeNil())
+					Expect(string(b)).To(Equal("fake-content"))
+					err = ns.Delete("http://example.com/")
+					Expect(err).To(BeNil())
+				}
+
+				// Chunked and gzipped responses are decoded, and
+				// other statuses and record types are skipped.
+				var gz bytes.Buffer
+				gw := gzip.NewWriter(&gz)
+				gw.Write([]byte("hello, world"))
+				gw.Close()
+				record := func(typ, uri, block string) string {
+					return "WARC/1.0\r\n" +
+						"WARC-Type: " + typ + "\r\n" +
+						"WARC-Target-URI: " + uri + "\r\n" +
+						"WARC-Date: 2019-06-01T00:00:00Z\r\n" +
+						"Content-Type: application/http; msgtype=" + typ + "\r\n" +
+						fmt.Sprintf("Content-Length: %d\r\n\r\n", len(block)) +
+						block + "\r\n\r\n"
+				}
+				warc := record("request", "http://example.org/", "GET / HTTP/1.1\r\nHost: example.org\r\n\r\n") +
+					record("response", "http://example.org/", "HTTP/1.1 200 OK\r\n"+
+						"Content-Type: text/plain\r\n"+
+						"Content-Encoding: gzip\r\n"+
+						"Transfer-Encoding: chunked\r\n\r\n"+
+						fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", gz.Len(), gz.String())) +
+					record("response", "http://example.org/missing", "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n")
+				ns, err := c.Namespace("import")
+				Expect(err).To(BeNil())
+				n, err := progszy.ImportWARC(strings.NewReader(warc), ns)
+				Expect(err).To(BeNil())
+				Expect(n).To(Equal(1))
+				cr, err := ns.Get("http://example.org/")
+				Expect(err).To(BeNil())
+				Expect(cr.Created).To(Equal(time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)))
+				Expect(cr.ContentLength).To(Equal(int64(12)))
+				_, err = ns.Get("http://example.org/missing")
+				Expect(err).To(Equal(progszy.ErrCacheMiss))
+
+			})
+
+			It("should expire imported records from their import time", func() {
+
+				// Large bodies are spooled, and stored in chunks.
+				large := randomContent(2 * 1024 * 1024)
+				cr, err := progszy.NewCacheRecord("http://example.com/large", 200, "HTTP/1.1", "", "application/octet-stream", "", "", large, 0, created)
+				Expect(err).To(BeNil())
+				err = c.Put(cr)
+				Expect(err).To(BeNil())
+				var buf bytes.Buffer
+				err = progszy.ExportWARC(&buf, c, bins[0].Name, progszy.WARCGzip)
+				Expect(err).To(BeNil())
+
+				ns, err := c.Namespace("import")
+				Expect(err).To(BeNil())
+				n, err := progszy.ImportWARC(&buf, ns)
+				Expect(err).To(BeNil())
+				Expect(n).To(Equal(2))
+				cr, err = ns.Get("http://example.com/large")
+				Expect(err).To(BeNil())
+				Expect(cr.Created).To(Equal(created))
+				Expect(time.Since(cr.Imported)).To(BeNumerically("<", time.Minute))
+				r, err := cr.Body()
+				Expect(err).To(BeNil())
+				b, err := io.ReadAll(r)
+				r.Close()
+				Expect(err).To(BeNil())
+				Expect(b).To(Equal(large))
+
+				// Though captured long ago, they were only just imported.
+				n, err = ns.Expire("example.com", time.Now().Add(-time.Hour), false)
+				Expect(err).To(BeNil())
+				Expect(n).To(Equal(0))
+				n, err = ns.Expire("example.com", time.Now().Add(time.Second), false)
+				Expect(err).To(BeNil())
+				Expect(n).To(Equal(2))
+
+				// Records stored as usual have no import time.
+				cr, err = c.Get("http://example.com/large")
+				Expect(err).To(BeNil())
+				Expect(cr.Imported.IsZero()).To(BeTrue())
+			})
+
+			It("should export and import HAR entries", func() {
+
+				cr, err := progszy.NewCacheRecord("http://example.com/?q=a+b", 200, "HTTP/1.1", "en", "text/html", `"abc"`, "", []byte("fake-content"), 123.5, created)
+				Expect(err).To(BeNil())
+				err = c.Put(cr)
+				Expect(err).To(BeNil())
+				binary := randomContent(100)
+				cr, err = progszy.NewCacheRecord("http://example.com/image", 200, "HTTP/1.1", "", "image/png", "", "", binary, 10, created)
+				Expect(err).To(BeNil())
+				err = c.Put(cr)
+				Expect(err).To(BeNil())
+
+				var buf bytes.Buffer
+				err = progszy.ExportHAR(&buf, c, bins[0].Name)
+				Expect(err).To(BeNil())
+				var har struct {
+					Log struct {
+						Entries []map[string]interface{} `json:"entries"`
+					} `json:"log"`
+				}
+				err = json.Unmarshal(buf.Bytes(), &har)
+				Expect(err).To(BeNil())
+				Expect(har.Log.Entries).To(HaveLen(3))
+				Expect(har.Log.Entries[1]).To(HaveKeyWithValue("time", 123.5))
+				Expect(har.Log.Entries[1]["request"]).To(HaveKeyWithValue("queryString", ContainElement(map[string]interface{}{"name": "q", "value": "a b"})))
+				Expect(har.Log.Entries[1]["response"]).To(HaveKeyWithValue("headers", ContainElement(map[string]interface{}{"name": "ETag", "value": `"abc"`})))
+				Expect(har.Log.Entries[2]["response"]).To(HaveKeyWithValue("content", HaveKeyWithValue("encoding", "base64")))
+
+				ns, err := c.Namespace("import")
+				Expect(err).To(BeNil())
+				n, err := progszy.ImportHAR(&buf, ns)
+				Expect(err).To(BeNil())
+				Expect(n).To(Equal(3))
+				cr, err = ns.Get("http://example.com/?q=a+b")
+				Expect(err).To(BeNil())
+				Expect(cr.Created).To(Equal(created))
+				Expect(cr.ResponseTime).To(Equal(123.5))
+				Expect(cr.ETag).To(Equal(`"abc"`))
+				Expect(cr.ContentLanguage).To(Equal("en"))
+				cr, err = ns.Get("http://example.com/image")
+				Expect(err).To(BeNil())
+				Expect(cr.ContentType).To(Equal("image/png"))
+				r, err := cr.Body()
+				Expect(err).To(BeNil())
+				b, err := io.ReadAll(r)
+				r.Close()
+				Expect(err).To(BeNil())
+				Expect(b).To(Equal(binary))
+
+				// Browser captures may omit content, and use other HTTP versions.
+				devtools := `{"log":{"version":"1.2","creator":{"name":"WebInspector","version":"537.36"},"entries":[
+					{"startedDateTime":"2019-06-01T01:02:03.456+01:00","time":42,
+					 "request":{"method":"GET","url":"http://example.org/","httpVersion":"h2","headers":[{"name":"Accept","value":"*/*"}]},
+					 "response":{"status":200,"statusText":"","httpVersion":"h2","headers":[{"name":"etag","value":"xyz"}],"content":{"size":5,"mimeType":"text/plain","text":"hello"}}},
+					{"startedDateTime":"2019-06-01T01:02:03Z","time":1,
+					 "request":{"method":"GET","url":"http://example.org/empty","httpVersion":"h2","headers":[]},
+					 "response":{"status":200,"httpVersion":"h2","headers":[],"content":{"size":5,"mimeType":"text/plain"}}},
+					{"startedDateTime":"2019-06-01T01:02:03Z","time":1,
+					 "request":{"method":"POST","url":"http://example.org/post","httpVersion":"h2","headers":[]},
+					 "response":{"status":200,"httpVersion":"h2","headers":[],"content":{"size":2,"mimeType":"text/plain","text":"ok"}}}
+				]}}`
+				n, err = progszy.ImportHAR(strings.NewReader(devtools), ns)
+				Expect(err).To(BeNil())
+				Expect(n).To(Equal(1))
+				cr, err = ns.Get("http://example.org/")
+				Expect(err).To(BeNil())
+				Expect(cr.Protocol).To(Equal("HTTP/2.0"))
+				Expect(cr.ETag).To(Equal("xyz"))
+				Expect(cr.ResponseTime).To(Equal(42.0))
+				Expect(cr.Created).To(Equal(time.Date(2019, 6, 1, 0, 2, 3, 456000000, time.UTC)))
+				_, err = ns.Get("http://example.org/empty")
+				Expect(err).To(Equal(progszy.ErrCacheMiss))
+				_, err = ns.Get("http://example.org/post")
+				Expect(err).To(Equal(progszy.ErrCacheMiss))
+
+			})
+		})
+
+		It("should export a bin to a tree of files", func() {
+
+			c := progszy.NewSqliteCache(testCachePath)
+			uris := []string{
+				"http://example.com/",
+				"http://example.com/a",
+				"http://example.com/a/b",
+				"http://example.com/a/b?y=2&x=1",
+				"http://example.com:8080/c%20d/e%2Ff",
+			}
+			for _, uri := range uris {
+				cr, err := progszy.NewCacheRecord(uri, 200, "", "", "text/plain", "", "", []byte(uri), 0, time.Now())
+				Expect(err).To(BeNil())
+				err = c.Put(cr)
+				Expect(err).To(BeNil())
+			}
+			bins, err := c.Bins()
+			Expect(err).To(BeNil())
+
+			dir := filepath.Join(testCachePath, "export")
+			defer os.RemoveAll(dir)
+			err = progszy.ExportFS(dir, c, bins[0].Name)
+			Expect(err).To(BeNil())
+
+			paths := map[string]string{
+				"http/example.com/index.html":            "http://example.com/",
+				"http/example.com/a":                     "http://example.com/a",
+				"http/example.com/a~1/b":                 "http://example.com/a/b",
+				"http/example.com/a~1/b%3Fx%3D1%26y%3D2": "http://example.com/a/b?y=2&x=1",
+				"http/example.com%3A8080/c%20d/e%2Ff":    "http://example.com:8080/c%20d/e%2Ff",
+			}
+			for p, uri := range paths {
+				b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(p)))
+				Expect(err).To(BeNil())
+				Expect(string(b)).To(Equal(uri))
+			}
+
+			b, err := os.ReadFile(filepath.Join(dir, "index.jsonl"))
+			Expect(err).To(BeNil())
+			lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+			Expect(lines).To(HaveLen(len(uris)))
+			for _, line := range lines {
+				var entry struct {
+					Path string `json:"path"`
+					URL  string `json:"url"`
+				}
+				err = json.Unmarshal([]byte(line), &entry)
+				Expect(err).To(BeNil())
+				Expect(paths).To(HaveKeyWithValue(entry.Path, entry.URL))
+			}
+
+			// The directory must be empty.
+			err = progszy.ExportFS(dir, c, bins[0].Name)
+			Expect(err).ToNot(BeNil())
+
+			err = c.CloseAll()
+			Expect(err).To(BeNil())
+		})
 	})
 
 })
+
+func randomContent(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jimsmart/progszy"
+)
+
+// cacheParams are the params of commands that operate directly on a cache.
+type cacheParams struct {
+	cache     *string
+	namespace *string
+	config    *string
+	binBy     *string
+}
+
+// addCacheParams adds the cache params to fs, including the binning params
+// if the command needs to find (or put) URLs in their bins.
+func addCacheParams(fs *flag.FlagSet, binning bool) *cacheParams {
+	p := &cacheParams{
+		cache:     fs.String("cache", "./cache", "Cache location"),
+		namespace: fs.String("namespace", "", "Cache namespace (default none)"),
+		config:    new(string),
+		binBy:     new(string),
+	}
+	if binning {
+		p.config = fs.String("config", "", "Config file (JSON), for its binning strategy")
+		p.binBy = fs.String("bin-by", "", `Binning strategy: "root", "fqdn", "host-port" or "regex" (rules from config file) (default "root")`)
+	}
+	return p
+}
+
+// open opens the cache (or namespace) given by the params.
+func (p *cacheParams) open() (progszy.Cache, error) {
+	cachePath, err := filepath.Abs(*p.cache)
+	if err != nil {
+		return nil, err
+	}
+	config := &progszy.Config{}
+	if len(*p.config) > 0 {
+		config, err = progszy.LoadConfig(*p.config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(*p.binBy) > 0 {
+		config.BinBy = *p.binBy
+	}
+	binner, err := config.Binner()
+	if err != nil {
+		return nil, err
+	}
+	return progszy.NewSqliteCacheWithBinner(cachePath, binner).Namespace(*p.namespace)
+}
+
+// binParamUsage is the usage of commands' -bin params.
+const binParamUsage = `a bin's filename, or a bin key (e.g. "example.com") for its current bin`
+
+// findBin returns the filename of the named bin,
+// given either its filename or its key (for its current bin).
+func findBin(cache progszy.Cache, name string) (string, error) {
+	if len(name) == 0 {
+		return "", errors.New("no bin given")
+	}
+	bins, err := cache.Bins()
+	if err != nil {
+		return "", err
+	}
+	for _, b := range bins {
+		if b.Name == name || (b.Current && b.BaseDomain == name) {
+			return b.Name, nil
+		}
+	}
+	return "", progszy.ErrNoSuchBin
+}
+
+// errUsage is returned by commands given invalid args,
+// after printing their usage.
+var errUsage = errors.New("invalid usage")
+
+// parseFlags parses args into fs, returning errUsage if they are invalid.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if err != nil && err != flag.ErrHelp {
+		return errUsage
+	}
+	return err
+}
+
+// setArgsUsage sets the usage of fs, for a command taking the given args.
+func setArgsUsage(fs *flag.FlagSet, args string) {
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] %s\n", os.Args[0], fs.Name(), args)
+		fs.PrintDefaults()
+	}
+}
+
+// parseTime parses an optional RFC3339 time param.
+func parseTime(name, value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -%s time %q", name, value)
+	}
+	return t, nil
+}
+
+// get implements the get command.
+func get(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	setArgsUsage(fs, "URL")
+	p := addCacheParams(fs, true)
+	includeParam := fs.Bool("i", false, "Include the response status line and headers before the body")
+	headParam := fs.Bool("I", false, "Print only the response status line and headers")
+	asOfParam := fs.String("as-of", "", `Get the URL as it was cached at the given time (RFC3339, e.g. "2020-03-20T16:40:00Z")`)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+	uri := fs.Arg(0)
+	asOf, err := parseTime("as-of", *asOfParam)
+	if err != nil {
+		return err
+	}
+
+	cache, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer cache.CloseAll()
+
+	var cr *progszy.CacheRecord
+	if asOf.IsZero() {
+		cr, err = cache.Peek(uri)
+	} else {
+		cr, err = cache.GetAsOf(uri, asOf)
+	}
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(stdout)
+	if *includeParam || *headParam {
+		w.WriteString(cr.ResponseHead())
+	}
+	if !*headParam {
+		body, err := cr.Body()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// ls implements the ls command.
+func ls(args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	p := addCacheParams(fs, false)
+	recordsParam := fs.Bool("records", false, "List the records in the current bins, instead of the bins (implied by -bin, and the filters below)")
+	binParam := fs.String("bin", "", "List the records in the given bin: "+binParamUsage)
+	matchParam := fs.String("match", "", "Only list records whose URL matches the given regexp")
+	statusParam := fs.String("status", "", `Only list records with the given status codes (e.g. "200,404,3xx")`)
+	typeParam := fs.String("type", "", `Only list records whose content type starts with the given prefix (e.g. "text/")`)
+	sinceParam := fs.String("since", "", `Only list records created at or after the given time (RFC3339, e.g. "2020-03-20T16:40:00Z")`)
+	beforeParam := fs.String("before", "", "Only list records created before the given time (RFC3339)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	var filters []func(cr *progszy.CacheRecord) bool
+	if len(*matchParam) > 0 {
+		re, err := regexp.Compile(*matchParam)
+		if err != nil {
+			return err
+		}
+		filters = append(filters, func(cr *progszy.CacheRecord) bool { return re.MatchString(cr.URL) })
+	}
+	if len(*statusParam) > 0 {
+		codes, err := progszy.ParseStatusCodes(*statusParam)
+		if err != nil {
+			return err
+		}
+		statuses := make(map[int]bool)
+		for _, c := range codes {
+			statuses[c] = true
+		}
+		filters = append(filters, func(cr *progszy.CacheRecord) bool { return statuses[cr.Status] })
+	}
+	if len(*typeParam) > 0 {
+		filters = append(filters, func(cr *progszy.CacheRecord) bool { return strings.HasPrefix(cr.ContentType, *typeParam) })
+	}
+	since, err := parseTime("since", *sinceParam)
+	if err != nil {
+		return err
+	}
+	if !since.IsZero() {
+		filters = append(filters, func(cr *progszy.CacheRecord) bool { return !cr.Created.Before(since) })
+	}
+	before, err := parseTime("before", *beforeParam)
+	if err != nil {
+		return err
+	}
+	if !before.IsZero() {
+		filters = append(filters, func(cr *progszy.CacheRecord) bool { return cr.Created.Before(before) })
+	}
+
+	cache, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer cache.CloseAll()
+	bins, err := cache.Bins()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	if !*recordsParam && len(*binParam) == 0 && len(filters) == 0 {
+		fmt.Fprintln(tw, "NAME\tKEY\tCREATED\tSIZE\tCURRENT")
+		for _, b := range bins {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%t\n", b.Name, b.BaseDomain, b.Created.Format(time.RFC3339), b.Size, b.Current)
+		}
+		return tw.Flush()
+	}
+
+	var names []string
+	if len(*binParam) > 0 {
+		name, err := findBin(cache, *binParam)
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+	} else {
+		for _, b := range bins {
+			if b.Current {
+				names = append(names, b.Name)
+			}
+		}
+	}
+	fmt.Fprintln(tw, "CREATED\tSTATUS\tLENGTH\tTYPE\tURL")
+	for _, name := range names {
+		err = cache.Walk(name, func(cr *progszy.CacheRecord) error {
+			for _, f := range filters {
+				if !f(cr) {
+					return nil
+				}
+			}
+			_, err := fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", cr.Created.Format(time.RFC3339), cr.Status, cr.ContentLength, cr.ContentType, cr.URL)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+// stats implements the stats command.
+func stats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	p := addCacheParams(fs, false)
+	jsonParam := fs.Bool("json", false, "Print the statistics as JSON (as the admin REST API does)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	cache, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer cache.CloseAll()
+	s, err := cache.Stats()
+	if err != nil {
+		return err
+	}
+
+	if *jsonParam {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	}
+
+	fmt.Fprintf(stdout, "Bins: %d\n", s.Bins)
+	fmt.Fprintf(stdout, "Size: %d bytes\n\n", s.Size)
+	var keys []string
+	for k := range s.Domains {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tRECORDS\tCONTENT\tCOMPRESSED")
+	for _, k := range keys {
+		d := s.Domains[k]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", k, d.Records, d.ContentLength, d.CompressedLength)
+	}
+	return tw.Flush()
+}
+
+// purge implements the purge command.
+func purge(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	setArgsUsage(fs, "[URL ...]")
+	p := addCacheParams(fs, true)
+	prefixParam := fs.Bool("prefix", false, "Remove all URLs starting with each given URL (e.g. a path subtree)")
+	matchParam := fs.String("match", "", "Remove all URLs in each given URL's current bin that match the given regexp")
+	olderThanParam := fs.Duration("older-than", 0, `Remove records older than the given age from all current bins (e.g. "720h")`)
+	archiveParam := fs.Bool("archive", false, "With -older-than, archive records into their bin's history, instead of removing them")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 && *olderThanParam <= 0 {
+		fs.Usage()
+		return errUsage
+	}
+	if *prefixParam && len(*matchParam) > 0 {
+		return errors.New("-prefix and -match cannot be used together")
+	}
+	var re *regexp.Regexp
+	if len(*matchParam) > 0 {
+		var err error
+		re, err = regexp.Compile(*matchParam)
+		if err != nil {
+			return err
+		}
+	}
+
+	cache, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer cache.CloseAll()
+
+	n := 0
+	for _, uri := range fs.Args() {
+		m := 0
+		switch {
+		case *prefixParam:
+			u, err := url.Parse(uri)
+			if err != nil {
+				return err
+			}
+			progszy.NormalisePath(u)
+			if err := progszy.NormaliseQuery(u); err != nil {
+				return err
+			}
+			key := u.String()
+			m, err = cache.DeleteMatching(uri, func(k string) bool { return strings.HasPrefix(k, key) })
+			if err != nil {
+				return err
+			}
+		case re != nil:
+			m, err = cache.DeleteMatching(uri, re.MatchString)
+			if err != nil {
+				return err
+			}
+		default:
+			err = cache.Delete(uri)
+			if err == nil {
+				m = 1
+			} else if err != progszy.ErrCacheMiss {
+				return err
+			}
+		}
+		n += m
+	}
+
+	if *olderThanParam > 0 {
+		before := time.Now().Add(-*olderThanParam)
+		bins, err := cache.Bins()
+		if err != nil {
+			return err
+		}
+		for _, b := range bins {
+			if !b.Current {
+				continue
+			}
+			m, err := cache.Expire(b.BaseDomain, before, *archiveParam)
+			if err != nil {
+				return err
+			}
+			n += m
+		}
+	}
+	fmt.Fprintf(stdout, "Purged %d records\n", n)
+	return nil
+}
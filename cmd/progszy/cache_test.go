@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/jimsmart/progszy"
+)
+
+var _ = Describe("Cache commands", func() {
+
+	var cachePath string
+	old := time.Now().Add(-2 * time.Hour)
+
+	BeforeEach(func() {
+		var err error
+		cachePath, err = os.MkdirTemp("", "progszy-cmd-")
+		Expect(err).To(BeNil())
+
+		c := progszy.NewSqliteCache(cachePath)
+		records := []struct {
+			uri     string
+			status  int
+			mime    string
+			created time.Time
+		}{
+			{"http://example.com/", 200, "text/html", old},
+			{"http://example.com/a/1", 200, "text/plain", time.Now()},
+			{"http://example.com/a/2", 404, "text/plain", time.Now()},
+			{"http://example.com/b.png", 200, "image/png", time.Now()},
+			{"http://example.org/", 200, "text/html", time.Now()},
+		}
+		for _, r := range records {
+			cr, err := progszy.NewCacheRecord(r.uri, r.status, "HTTP/1.1", "", r.mime, "", "", []byte("content of "+r.uri), 0, r.created)
+			Expect(err).To(BeNil())
+			err = c.Put(cr)
+			Expect(err).To(BeNil())
+		}
+		err = c.CloseAll()
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		err := os.RemoveAll(cachePath)
+		Expect(err).To(BeNil())
+	})
+
+	// run runs the given command on the test cache, returning its output.
+	run := func(cmd func([]string) error, args ...string) (string, error) {
+		var buf bytes.Buffer
+		stdout = &buf
+		defer func() { stdout = os.Stdout }()
+		err := cmd(append([]string{"-cache", cachePath}, args...))
+		return buf.String(), err
+	}
+
+	// listed returns the URLs listed by ls, in order.
+	listed := func(out string) []string {
+		var uris []string
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		Expect(lines[0]).To(HavePrefix("CREATED"))
+		for _, line := range lines[1:] {
+			f := strings.Fields(line)
+			uris = append(uris, f[len(f)-1])
+		}
+		return uris
+	}
+
+	// cached reports whether the given URL is in the test cache.
+	cached := func(uri string) bool {
+		c := progszy.NewSqliteCache(cachePath)
+		defer c.CloseAll()
+		_, err := c.Peek(uri)
+		if err == progszy.ErrCacheMiss {
+			return false
+		}
+		Expect(err).To(BeNil())
+		return true
+	}
+
+	Describe("get", func() {
+
+		It("should print the body of a URL", func() {
+			out, err := run(get, "http://example.com/a/1")
+			Expect(err).To(BeNil())
+			Expect(out).To(Equal("content of http://example.com/a/1"))
+		})
+
+		It("should print the headers of a URL, with or without its body", func() {
+			out, err := run(get, "-i", "http://example.com/a/1")
+			Expect(err).To(BeNil())
+			Expect(out).To(HavePrefix("HTTP/1.1 200 OK\r\n"))
+			Expect(out).To(ContainSubstring("Content-Type: text/plain\r\n"))
+			Expect(out).To(HaveSuffix("\r\n\r\ncontent of http://example.com/a/1"))
+
+			out, err = run(get, "-I", "http://example.com/a/2")
+			Expect(err).To(BeNil())
+			Expect(out).To(HavePrefix("HTTP/1.1 404 Not Found\r\n"))
+			Expect(out).To(HaveSuffix("\r\n\r\n"))
+		})
+
+		It("should get a URL as of a given time", func() {
+			out, err := run(get, "-as-of", time.Now().Add(time.Hour).Format(time.RFC3339), "http://example.com/")
+			Expect(err).To(BeNil())
+			Expect(out).To(Equal("content of http://example.com/"))
+
+			// No bin was created by then.
+			_, err = run(get, "-as-of", old.Format(time.RFC3339), "http://example.com/")
+			Expect(err).To(Equal(progszy.ErrCacheMiss))
+		})
+
+		It("should return errors, rather than exit", func() {
+			_, err := run(get, "http://example.com/unknown")
+			Expect(err).To(Equal(progszy.ErrCacheMiss))
+			_, err = run(get, "-as-of", "yesterday", "http://example.com/")
+			Expect(err).ToNot(BeNil())
+			_, err = run(get)
+			Expect(err).To(Equal(errUsage))
+		})
+	})
+
+	Describe("ls", func() {
+
+		It("should list the bins", func() {
+			out, err := run(ls)
+			Expect(err).To(BeNil())
+			lines := strings.Split(strings.TrimSpace(out), "\n")
+			Expect(lines).To(HaveLen(3))
+			Expect(lines[0]).To(HavePrefix("NAME"))
+			var keys []string
+			for _, line := range lines[1:] {
+				f := strings.Fields(line)
+				keys = append(keys, f[1])
+				Expect(f[len(f)-1]).To(Equal("true"))
+			}
+			Expect(keys).To(ConsistOf("example.com", "example.org"))
+		})
+
+		It("should list the records in the current bins", func() {
+			out, err := run(ls, "-records")
+			Expect(err).To(BeNil())
+			Expect(listed(out)).To(ConsistOf(
+				"http://example.com/",
+				"http://example.com/a/1",
+				"http://example.com/a/2",
+				"http://example.com/b.png",
+				"http://example.org/",
+			))
+		})
+
+		It("should list the records in a given bin", func() {
+			out, err := run(ls, "-bin", "example.org")
+			Expect(err).To(BeNil())
+			Expect(listed(out)).To(Equal([]string{"http://example.org/"}))
+
+			_, err = run(ls, "-bin", "example.net")
+			Expect(err).To(Equal(progszy.ErrNoSuchBin))
+		})
+
+		It("should filter the records listed", func() {
+			out, err := run(ls, "-match", "/a/")
+			Expect(err).To(BeNil())
+			Expect(listed(out)).To(ConsistOf("http://example.com/a/1", "http://example.com/a/2"))
+
+			out, err = run(ls, "-status", "404")
+			Expect(err).To(BeNil())
+			Expect(listed(out)).To(ConsistOf("http://example.com/a/2"))
+
+			out, err = run(ls, "-status", "2xx", "-type", "text/")
+			Expect(err).To(BeNil())
+			Expect(listed(out)).To(ConsistOf("http://example.com/", "http://example.com/a/1", "http://example.org/"))
+
+			hourAgo := time.Now().Add(-time.Hour).Format(time.RFC3339)
+			out, err = run(ls, "-before", hourAgo)
+			Expect(err).To(BeNil())
+			Expect(listed(out)).To(ConsistOf("http://example.com/"))
+
+			out, err = run(ls, "-since", hourAgo, "-bin", "example.com")
+			Expect(err).To(BeNil())
+			Expect(listed(out)).To(ConsistOf("http://example.com/a/1", "http://example.com/a/2", "http://example.com/b.png"))
+
+			// A filter matching nothing lists only the header.
+			out, err = run(ls, "-match", "nothing")
+			Expect(err).To(BeNil())
+			Expect(listed(out)).To(BeEmpty())
+		})
+
+		It("should return errors for invalid filters", func() {
+			_, err := run(ls, "-match", "(")
+			Expect(err).ToNot(BeNil())
+			_, err = run(ls, "-status", "2zz")
+			Expect(err).ToNot(BeNil())
+			_, err = run(ls, "-since", "today")
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("stats", func() {
+
+		It("should print statistics", func() {
+			out, err := run(stats)
+			Expect(err).To(BeNil())
+			Expect(out).To(HavePrefix("Bins: 2\n"))
+			Expect(out).To(MatchRegexp(`(?m)^example\.com +4 +\d+ +\d+$`))
+			Expect(out).To(MatchRegexp(`(?m)^example\.org +1 +\d+ +\d+$`))
+		})
+
+		It("should print statistics as JSON", func() {
+			out, err := run(stats, "-json")
+			Expect(err).To(BeNil())
+			var s progszy.CacheStats
+			err = json.Unmarshal([]byte(out), &s)
+			Expect(err).To(BeNil())
+			Expect(s.Bins).To(Equal(2))
+			Expect(s.Domains).To(HaveLen(2))
+			Expect(s.Domains["example.com"].Records).To(Equal(int64(4)))
+			Expect(s.Domains["example.org"].Records).To(Equal(int64(1)))
+		})
+	})
+
+	Describe("purge", func() {
+
+		It("should remove the given URLs", func() {
+			out, err := run(purge, "http://example.com/a/1", "http://example.org/", "http://example.com/unknown")
+			Expect(err).To(BeNil())
+			Expect(out).To(Equal("Purged 2 records\n"))
+			Expect(cached("http://example.com/a/1")).To(BeFalse())
+			Expect(cached("http://example.org/")).To(BeFalse())
+			Expect(cached("http://example.com/a/2")).To(BeTrue())
+		})
+
+		It("should remove URLs by prefix", func() {
+			out, err := run(purge, "-prefix", "http://example.com/a/")
+			Expect(err).To(BeNil())
+			Expect(out).To(Equal("Purged 2 records\n"))
+			Expect(cached("http://example.com/a/1")).To(BeFalse())
+			Expect(cached("http://example.com/a/2")).To(BeFalse())
+			Expect(cached("http://example.com/")).To(BeTrue())
+		})
+
+		It("should remove URLs matching a regexp", func() {
+			out, err := run(purge, "-match", `\.png$`, "http://example.com/")
+			Expect(err).To(BeNil())
+			Expect(out).To(Equal("Purged 1 records\n"))
+			Expect(cached("http://example.com/b.png")).To(BeFalse())
+			Expect(cached("http://example.com/")).To(BeTrue())
+		})
+
+		It("should remove records older than a given age", func() {
+			out, err := run(purge, "-older-than", "1h")
+			Expect(err).To(BeNil())
+			Expect(out).To(Equal("Purged 1 records\n"))
+			Expect(cached("http://example.com/")).To(BeFalse())
+			Expect(cached("http://example.com/a/1")).To(BeTrue())
+			Expect(cached("http://example.org/")).To(BeTrue())
+
+			c := progszy.NewSqliteCache(cachePath)
+			defer c.CloseAll()
+			versions, err := c.Versions("http://example.com/")
+			Expect(err).To(BeNil())
+			Expect(versions).To(BeEmpty())
+		})
+
+		It("should archive records older than a given age", func() {
+			out, err := run(purge, "-older-than", "1h", "-archive")
+			Expect(err).To(BeNil())
+			Expect(out).To(Equal("Purged 1 records\n"))
+			Expect(cached("http://example.com/")).To(BeFalse())
+
+			c := progszy.NewSqliteCache(cachePath)
+			defer c.CloseAll()
+			versions, err := c.Versions("http://example.com/")
+			Expect(err).To(BeNil())
+			Expect(versions).To(HaveLen(1))
+		})
+
+		It("should return errors for invalid args", func() {
+			_, err := run(purge)
+			Expect(err).To(Equal(errUsage))
+			_, err = run(purge, "-prefix", "-match", "x", "http://example.com/")
+			Expect(err).ToNot(BeNil())
+			_, err = run(purge, "-match", "(", "http://example.com/")
+			Expect(err).ToNot(BeNil())
+			Expect(cached("http://example.com/")).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/jimsmart/progszy"
+)
+
+// exportWARC implements the export-warc command.
+func exportWARC(args []string) error {
+	fs := flag.NewFlagSet("export-warc", flag.ContinueOnError)
+	p := addCacheParams(fs, false)
+	binParam := fs.String("bin", "", "Bin to export: "+binParamUsage)
+	compressParam := fs.String("compress", "gzip", `Record compression: "gzip", "zstd" or "none"`)
+	outParam := fs.String("o", "", "Output file (default stdout)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	compression := *compressParam
+	if compression == "none" {
+		compression = progszy.WARCUncompressed
+	}
+
+	cache, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer cache.CloseAll()
+	bin, err := findBin(cache, *binParam)
+	if err != nil {
+		return err
+	}
+
+	w, err := createOutput(*outParam)
+	if err != nil {
+		return err
+	}
+	err = progszy.ExportWARC(w, cache, bin, compression)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// exportHAR implements the export-har command.
+func exportHAR(args []string) error {
+	fs := flag.NewFlagSet("export-har", flag.ContinueOnError)
+	p := addCacheParams(fs, false)
+	binParam := fs.String("bin", "", "Bin to export: "+binParamUsage)
+	outParam := fs.String("o", "", "Output file (default stdout)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	cache, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer cache.CloseAll()
+	bin, err := findBin(cache, *binParam)
+	if err != nil {
+		return err
+	}
+
+	w, err := createOutput(*outParam)
+	if err != nil {
+		return err
+	}
+	err = progszy.ExportHAR(w, cache, bin)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// exportFS implements the export-fs command.
+func exportFS(args []string) error {
+	fs := flag.NewFlagSet("export-fs", flag.ContinueOnError)
+	p := addCacheParams(fs, false)
+	binParam := fs.String("bin", "", "Bin to export: "+binParamUsage)
+	dirParam := fs.String("dir", "", "Output directory, which must be empty or not exist")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if len(*dirParam) == 0 {
+		return errors.New("no output directory given")
+	}
+
+	cache, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer cache.CloseAll()
+	bin, err := findBin(cache, *binParam)
+	if err != nil {
+		return err
+	}
+
+	return progszy.ExportFS(*dirParam, cache, bin)
+}
+
+// output is a buffered output file, or stdout.
+type output struct {
+	*bufio.Writer
+	f *os.File
+}
+
+// createOutput creates the named output file, or uses stdout if name is empty.
+func createOutput(name string) (*output, error) {
+	if len(name) == 0 {
+		return &output{bufio.NewWriter(stdout), nil}, nil
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &output{bufio.NewWriter(f), f}, nil
+}
+
+// Close flushes the output, and closes the file (if not stdout).
+func (o *output) Close() error {
+	err := o.Flush()
+	if o.f == nil {
+		return err
+	}
+	if cerr := o.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
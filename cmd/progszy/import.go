@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jimsmart/progszy"
+)
+
+// importWARC implements the import-warc command.
+func importWARC(args []string) error {
+	return importFiles("import-warc", args, progszy.ImportWARC)
+}
+
+// importHAR implements the import-har command.
+func importHAR(args []string) error {
+	return importFiles("import-har", args, progszy.ImportHAR)
+}
+
+// importFiles implements an import command, importing
+// each of the files given in args (default stdin).
+func importFiles(cmd string, args []string, importFn func(io.Reader, progszy.Cache, ...int) (int, error)) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	setArgsUsage(fs, "[file ...]")
+	p := addCacheParams(fs, true)
+	cacheableParam := fs.String("cacheable", "200", `Status codes to import (e.g. "200,404,410,3xx")`)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	cacheable, err := progszy.ParseStatusCodes(*cacheableParam)
+	if err != nil {
+		return err
+	}
+
+	cache, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer cache.CloseAll()
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		n, err := importFile(name, cache, cacheable, importFn)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Imported %d records from %s\n", n, name)
+	}
+	return nil
+}
+
+// importFile imports the named file (or stdin, if name is "-").
+func importFile(name string, cache progszy.Cache, cacheable []int, importFn func(io.Reader, progszy.Cache, ...int) (int, error)) (int, error) {
+	if name == "-" {
+		return importFn(os.Stdin, cache, cacheable...)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return importFn(f, cache, cacheable...)
+}
@@ -3,48 +3,82 @@ package main
 import (
 	"flag"
 	"fmt"
-	"net/url"
+	"io"
 	"os"
-	"path/filepath"
-	"strconv"
-
-	"github.com/jimsmart/progszy"
+	"strings"
 )
 
-// TODO Review/improve error handling.
+// commands maps each command name to its implementation.
+var commands = map[string]func(args []string) error{
+	"serve":       serve,
+	"get":         get,
+	"ls":          ls,
+	"stats":       stats,
+	"purge":       purge,
+	"export-warc": exportWARC,
+	"import-warc": importWARC,
+	"export-har":  exportHAR,
+	"import-har":  importHAR,
+	"export-fs":   exportFS,
+}
 
-func main() {
+const usage = `Usage: %s <command> [flags] [args]
 
-	var err error
+Commands:
+  serve        Run the caching proxy (the default, if no command is given)
+  get          Print the cached body and/or headers of a URL
+  ls           List the cache's bins, or the records in them
+  stats        Print cache statistics
+  purge        Remove URLs from the cache
+  export-warc  Export a bin as a WARC file
+  import-warc  Import WARC files into the cache
+  export-har   Export a bin as a HAR file
+  import-har   Import HAR files into the cache
+  export-fs    Mirror a bin to a tree of files
 
-	portParam := flag.Int("port", 5595, "Port number to listen on")
-	cacheParam := flag.String("cache", "./cache", "Cache location")
-	proxyParam := flag.String("proxy", "", `Upstream HTTP(S) proxy URL (e.g. "http://10.0.0.1:8080")`)
-	flag.Parse()
+Run '%[1]s <command> -help' for a command's flags.
+`
 
-	listenAddr := ":" + strconv.Itoa(*portParam)
+// stdout is where commands write their output.
+var stdout io.Writer = os.Stdout
 
-	cachePath := *cacheParam
-	// if !filepath.IsAbs(cachePath) {
-	cachePath, err = filepath.Abs(cachePath)
-	if err != nil {
-		fmt.Printf("Error: %s", err)
-		os.Exit(1)
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && !isHelp(args[0]) {
+		// No command, as in earlier versions.
+		exitOnError(serve(args))
+		return
+	}
+	if isHelp(args[0]) {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		return
 	}
-	// }
-
-	var proxy *url.URL
-	if len(*proxyParam) > 0 {
-		proxy, err = url.Parse(*proxyParam)
-		if err != nil {
-			fmt.Printf("Error: %s", err)
-			os.Exit(1)
-		}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
 	}
+	exitOnError(cmd(args[1:]))
+}
+
+// exitOnError reports a command's error, if any, and exits
+// with status 1, or status 2 if the command's usage was invalid.
+func exitOnError(err error) {
+	switch err {
+	case nil, flag.ErrHelp:
+		return
+	case errUsage:
+		os.Exit(2)
+	}
+	fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+	os.Exit(1)
+}
 
-	err = progszy.Run(listenAddr, cachePath, proxy)
-	if err != nil {
-		fmt.Printf("Error: %s", err)
-		os.Exit(1)
+func isHelp(arg string) bool {
+	switch arg {
+	case "help", "-h", "-help", "--help":
+		return true
 	}
+	return false
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jimsmart/progszy"
+)
+
+// serve implements the serve command, running the caching proxy.
+func serve(args []string) error {
+
+	var err error
+
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+
+	portParam := fs.Int("port", 5595, "Port number to listen on")
+	adminParam := fs.Int("admin", 0, "Port number for the admin REST API to listen on (default disabled)")
+	cacheParam := fs.String("cache", "./cache", "Cache location")
+	proxyParam := fs.String("proxy", "", `Upstream HTTP(S) proxy URL (e.g. "http://10.0.0.1:8080")`)
+	cacheableParam := fs.String("cacheable", "200", `Upstream status codes to cache (e.g. "200,404,410,3xx")`)
+	offlineParam := fs.Bool("offline", false, "Serve only from the cache, never contact upstream")
+	configParam := fs.String("config", "", "Config file (JSON) for global and per domain settings")
+	rateParam := fs.String("rate", "", `Upstream request rate limit per domain (e.g. "2/s", "30/m", "1/5s")`)
+	burstParam := fs.Int("burst", 0, "Upstream request burst size per domain (default 1)")
+	maxInFlightParam := fs.Int("max-in-flight", 0, "Max concurrent upstream requests per domain (default unlimited)")
+	maxBackoffParam := fs.Duration("max-backoff", 0, `Max time a domain's Retry-After can pause upstream requests (e.g. "10m") (default 5m)`)
+	gzipParam := fs.Bool("gzip", false, "Transcode cached content to gzip, for clients that accept gzip but not zstd")
+	ttlParam := fs.Duration("ttl", 0, `How long cached content is served for, before it expires (e.g. "720h") (default forever)`)
+	archiveParam := fs.Bool("archive", false, "Archive expired content into its bin's history, instead of deleting it")
+	versionsParam := fs.Bool("versions", false, "Keep previous versions of refetched content in its bin's history, instead of replacing it")
+	quotaParam := fs.String("quota", "", `Max size of cached content per domain, compressed (e.g. "1GB") (default unlimited)`)
+	totalQuotaParam := fs.String("total-quota", "", `Max total size of cached content, compressed (e.g. "20GB") (default unlimited)`)
+	binByParam := fs.String("bin-by", "", `Binning strategy: "root", "fqdn", "host-port" or "regex" (rules from config file) (default "root")`)
+	fallbackParam := fs.String("fallback", "", `Use older bins on a miss: "copy" them forward, or "refetch" and use them if upstream fails (default off)`)
+	staleIfErrorParam := fs.Bool("stale-if-error", false, "Serve a previous copy of content from the cache when upstream fails")
+	maxAgeParam := fs.Duration("max-age", 0, `Max age of cached content before revalidating with upstream (e.g. "24h") (default never)`)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	listenAddr := ":" + strconv.Itoa(*portParam)
+
+	cachePath := *cacheParam
+	// if !filepath.IsAbs(cachePath) {
+	cachePath, err = filepath.Abs(cachePath)
+	if err != nil {
+		return err
+	}
+	// }
+
+	var proxy *url.URL
+	if len(*proxyParam) > 0 {
+		proxy, err = url.Parse(*proxyParam)
+		if err != nil {
+			return err
+		}
+	}
+
+	cacheable, err := progszy.ParseStatusCodes(*cacheableParam)
+	if err != nil {
+		return err
+	}
+
+	config := &progszy.Config{}
+	if len(*configParam) > 0 {
+		config, err = progszy.LoadConfig(*configParam)
+		if err != nil {
+			return err
+		}
+	}
+	// Params override the config file's global settings.
+	if len(*rateParam) > 0 {
+		_, err = progszy.ParseRate(*rateParam)
+		if err != nil {
+			return err
+		}
+		config.Rate = *rateParam
+	}
+	if *burstParam > 0 {
+		config.Burst = *burstParam
+	}
+	if *maxInFlightParam > 0 {
+		config.MaxInFlight = *maxInFlightParam
+	}
+	if *maxBackoffParam > 0 {
+		config.MaxBackoff = maxBackoffParam.String()
+	}
+	if *ttlParam > 0 {
+		config.TTL = ttlParam.String()
+	}
+	if *archiveParam {
+		config.Archive = true
+	}
+	if *versionsParam {
+		config.Versions = true
+	}
+	if len(*quotaParam) > 0 {
+		_, err = progszy.ParseSize(*quotaParam)
+		if err != nil {
+			return err
+		}
+		config.Quota = *quotaParam
+	}
+	if len(*totalQuotaParam) > 0 {
+		_, err = progszy.ParseSize(*totalQuotaParam)
+		if err != nil {
+			return err
+		}
+		config.TotalQuota = *totalQuotaParam
+	}
+
+	if len(*binByParam) > 0 {
+		config.BinBy = *binByParam
+		_, err = config.Binner()
+		if err != nil {
+			return err
+		}
+	}
+
+	fallback, err := progszy.ParseFallback(*fallbackParam)
+	if err != nil {
+		return err
+	}
+
+	maxAge := time.Duration(-1)
+	if *maxAgeParam > 0 {
+		maxAge = *maxAgeParam
+	}
+
+	adminAddr := ""
+	if *adminParam > 0 {
+		adminAddr = ":" + strconv.Itoa(*adminParam)
+	}
+
+	return progszy.Run(listenAddr, cachePath, proxy,
+		progszy.WithCacheableStatus(cacheable...),
+		progszy.WithOffline(*offlineParam),
+		progszy.WithConfig(config),
+		progszy.WithMaxAge(maxAge),
+		progszy.WithGzip(*gzipParam),
+		progszy.WithAdmin(adminAddr),
+		progszy.WithFallback(fallback),
+		progszy.WithStaleIfError(*staleIfErrorParam),
+	)
+}
@@ -0,0 +1,317 @@
+package progszy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds settings that apply either globally,
+// or to an individual base domain, typically read from
+// a JSON config file. For example:
+//
+//	{
+//		"rate": "2/s",
+//		"max_in_flight": 4,
+//		"ttl": "720h",
+//		"quota": "1GB",
+//		"total_quota": "20GB",
+//		"bin_by": "regex",
+//		"bins": [
+//			{ "match": "^https?://([^/]+\\.)?example\\.(com|org)/", "bin": "example" }
+//		],
+//		"domains": {
+//			"example.com": { "rate": "1/5s", "max_in_flight": 1, "ttl": "24h", "quota": "5GB" }
+//		}
+//	}
+type Config struct {
+	// DomainConfig holds the global (default) settings.
+	DomainConfig
+	// Archive moves expired records into their bin's history,
+	// instead of deleting them.
+	Archive bool `json:"archive,omitempty"`
+	// Versions keeps the previous versions of refetched records
+	// in their bin's history, instead of deleting them.
+	Versions bool `json:"versions,omitempty"`
+	// TotalQuota limits the total compressed size of all cached responses,
+	// e.g. "20GB". Empty is unlimited.
+	TotalQuota string `json:"total_quota,omitempty"`
+	// BinBy is the binning strategy: "root" (the default), "fqdn",
+	// "host-port" or "regex". See NewBinner.
+	BinBy string `json:"bin_by,omitempty"`
+	// Bins holds the rules for the "regex" binning strategy.
+	Bins []BinRule `json:"bins,omitempty"`
+	// Domains holds settings for individual base domains,
+	// which override the global settings.
+	Domains map[string]DomainConfig `json:"domains,omitempty"`
+}
+
+// DomainConfig holds settings for a base domain.
+// Empty fields take their value from the global settings.
+type DomainConfig struct {
+	// Rate limits upstream requests, e.g. "2/s", "30/m", "1/5s",
+	// or a plain number of requests per second.
+	Rate string `json:"rate,omitempty"`
+	// Burst is the number of upstream requests allowed in a burst (default 1).
+	Burst int `json:"burst,omitempty"`
+	// MaxInFlight limits the number of concurrent upstream requests.
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+	// MaxBackoff limits how long a host's Retry-After can pause upstream
+	// requests, e.g. "10m", or a plain number of seconds (default 5m).
+	MaxBackoff string `json:"max_backoff,omitempty"`
+	// TTL is how long cached responses are served for, before they expire,
+	// e.g. "24h", or a plain number of seconds. Empty is forever.
+	TTL string `json:"ttl,omitempty"`
+	// Quota limits the total compressed size of cached responses,
+	// e.g. "1GB". Empty is unlimited.
+	Quota string `json:"quota,omitempty"`
+}
+
+// LoadConfig reads a Config from the given JSON file.
+func LoadConfig(filename string) (*Config, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	c := Config{}
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %v", filename, err)
+	}
+	err = c.validate()
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %v", filename, err)
+	}
+	return &c, nil
+}
+
+func (c *Config) validate() error {
+	err := c.DomainConfig.validate()
+	if err != nil {
+		return err
+	}
+	_, err = ParseSize(c.TotalQuota)
+	if err != nil {
+		return err
+	}
+	_, err = c.Binner()
+	if err != nil {
+		return err
+	}
+	for bd, dc := range c.Domains {
+		err = dc.validate()
+		if err != nil {
+			return fmt.Errorf("domain %s: %v", bd, err)
+		}
+	}
+	return nil
+}
+
+func (dc *DomainConfig) validate() error {
+	if len(dc.Rate) > 0 {
+		_, err := ParseRate(dc.Rate)
+		if err != nil {
+			return err
+		}
+	}
+	if dc.Burst < 0 {
+		return fmt.Errorf("invalid burst %d", dc.Burst)
+	}
+	if dc.MaxInFlight < 0 {
+		return fmt.Errorf("invalid max_in_flight %d", dc.MaxInFlight)
+	}
+	if len(dc.MaxBackoff) > 0 {
+		_, err := ParseMaxBackoff(dc.MaxBackoff)
+		if err != nil {
+			return err
+		}
+	}
+	if len(dc.TTL) > 0 {
+		_, err := ParseTTL(dc.TTL)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := ParseSize(dc.Quota)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Binner returns the Binner for the configured binning strategy.
+func (c *Config) Binner() (Binner, error) {
+	return NewBinner(c.BinBy, c.Bins)
+}
+
+// domain returns the effective settings for the given base domain.
+// Bin keys that are not configured, such as host names when binning
+// by FQDN, take the settings of their base domain.
+func (c *Config) domain(bd string) DomainConfig {
+	dc := c.DomainConfig
+	if c.Domains == nil {
+		return dc
+	}
+	o, ok := c.Domains[bd]
+	if !ok {
+		if root, err := BaseDomainName(&url.URL{Host: bd}); err == nil {
+			o, ok = c.Domains[root]
+		}
+	}
+	if ok {
+		if len(o.Rate) > 0 {
+			dc.Rate = o.Rate
+		}
+		if o.Burst > 0 {
+			dc.Burst = o.Burst
+		}
+		if o.MaxInFlight > 0 {
+			dc.MaxInFlight = o.MaxInFlight
+		}
+		if len(o.MaxBackoff) > 0 {
+			dc.MaxBackoff = o.MaxBackoff
+		}
+		if len(o.TTL) > 0 {
+			dc.TTL = o.TTL
+		}
+		if len(o.Quota) > 0 {
+			dc.Quota = o.Quota
+		}
+	}
+	return dc
+}
+
+// ttl returns the effective TTL for the given base domain, zero is forever.
+func (c *Config) ttl(bd string) time.Duration {
+	// TTL has already been validated.
+	ttl, _ := ParseTTL(c.domain(bd).TTL)
+	return ttl
+}
+
+// quota returns the effective quota for the given base domain, zero is unlimited.
+func (c *Config) quota(bd string) int64 {
+	// Quota has already been validated.
+	n, _ := ParseSize(c.domain(bd).Quota)
+	return n
+}
+
+// totalQuota returns the total quota, zero is unlimited.
+func (c *Config) totalQuota() int64 {
+	n, _ := ParseSize(c.TotalQuota)
+	return n
+}
+
+// hasQuotas reports whether any quota is configured,
+// either the total quota, or for any base domain.
+func (c *Config) hasQuotas() bool {
+	if c.totalQuota() > 0 {
+		return true
+	}
+	if n, _ := ParseSize(c.Quota); n > 0 {
+		return true
+	}
+	for _, dc := range c.Domains {
+		if n, _ := ParseSize(dc.Quota); n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// sizeUnits are the multipliers for ParseSize.
+var sizeUnits = map[string]float64{
+	"":    1,
+	"B":   1,
+	"K":   1e3,
+	"KB":  1e3,
+	"M":   1e6,
+	"MB":  1e6,
+	"G":   1e9,
+	"GB":  1e9,
+	"T":   1e12,
+	"TB":  1e12,
+	"KIB": 1 << 10,
+	"MIB": 1 << 20,
+	"GIB": 1 << 30,
+	"TIB": 1 << 40,
+}
+
+// ParseSize parses a size in bytes, such as "500MB", "20GB" or "1.5GiB",
+// or a plain number of bytes. An empty size is zero, meaning unlimited.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return 0, nil
+	}
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i == -1 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	unit, ok := sizeUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+	if err != nil || !ok {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * unit), nil
+}
+
+// ParseTTL parses a TTL, either as a duration (e.g. "24h"),
+// or as a plain number of seconds. An empty TTL is zero, meaning forever.
+func ParseTTL(s string) (time.Duration, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	d, ok := parseDuration(s)
+	if !ok || d < 0 {
+		return 0, fmt.Errorf("invalid ttl %q", s)
+	}
+	return d, nil
+}
+
+// defaultMaxBackoff is the default limit on how long
+// a host's Retry-After can pause upstream requests.
+const defaultMaxBackoff = 5 * time.Minute
+
+// ParseMaxBackoff parses a maximum backoff, either as a duration (e.g. "10m"),
+// or as a plain number of seconds. An empty maximum is the default (5m).
+func ParseMaxBackoff(s string) (time.Duration, error) {
+	if len(s) == 0 {
+		return defaultMaxBackoff, nil
+	}
+	d, ok := parseDuration(s)
+	if !ok || d <= 0 {
+		return 0, fmt.Errorf("invalid max_backoff %q", s)
+	}
+	return d, nil
+}
+
+// ParseRate parses a rate limit, returning the number of requests per second.
+// The rate is given as a number of requests per period, such as "2/s", "30/m"
+// or "1/5s", or as a plain number of requests per second, such as "0.5".
+// A rate of zero means unlimited.
+func ParseRate(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	n, per, ok := strings.Cut(s, "/")
+	count, err := strconv.ParseFloat(n, 64)
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	if !ok {
+		return count, nil
+	}
+	if len(per) > 0 && (per[0] < '0' || per[0] > '9') {
+		// Bare unit, e.g. "s".
+		per = "1" + per
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return count / d.Seconds(), nil
+}
@@ -0,0 +1,175 @@
+package progszy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines around each change in a diff.
+const diffContext = 3
+
+// maxDiffEdits limits the work (and memory) used to find a minimal diff.
+// Beyond this, the diff simply replaces all of a with all of b.
+const maxDiffEdits = 2000
+
+// diffOp is a single line of an edit script: kind is ' ' (unchanged),
+// '-' (deleted from a) or '+' (inserted from b). ai and bi are the
+// number of lines of a and b before this line.
+type diffOp struct {
+	kind   byte
+	ai, bi int
+	line   string
+}
+
+// unifiedDiff returns a unified diff of the lines of a and b,
+// labelled with the given names. It returns the empty string
+// if they are the same.
+func unifiedDiff(aName, bName, a, b string) string {
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	var sb strings.Builder
+	for i := 0; i < len(ops); {
+		// Find the next change.
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		// Extend the hunk while changes are close together.
+		last := i
+		for j := i; j < len(ops) && j-last <= 2*diffContext; j++ {
+			if ops[j].kind != ' ' {
+				last = j
+			}
+		}
+		start := max(i-diffContext, 0)
+		end := min(last+diffContext+1, len(ops))
+		hunk := ops[start:end]
+
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", aName, bName)
+		}
+		na, nb := 0, 0
+		for _, op := range hunk {
+			if op.kind != '+' {
+				na++
+			}
+			if op.kind != '-' {
+				nb++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(hunk[0].ai, na), hunkRange(hunk[0].bi, nb))
+		for _, op := range hunk {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return sb.String()
+}
+
+// hunkRange formats the start and length of a hunk's lines.
+func hunkRange(before, n int) string {
+	if n == 0 {
+		// An empty range is given as the line before it.
+		return fmt.Sprintf("%d,0", before)
+	}
+	return fmt.Sprintf("%d,%d", before+1, n)
+}
+
+// splitLines splits s into lines, each keeping its newline (if any).
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns a minimal edit script from a to b,
+// using Myers' algorithm.
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+
+	// For each number of edits d, v holds the furthest x reached
+	// on each diagonal k = x - y, and trace holds a copy of v
+	// (diagonals -d..d) before each step.
+	off := n + m + 1
+	v := make([]int, 2*off+1)
+	var trace [][]int
+	found := false
+	for d := 0; d <= n+m && d <= maxDiffEdits && !found; d++ {
+		trace = append(trace, append([]int(nil), v[off-d:off+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	if !found {
+		// Too many changes, replace everything.
+		var ops []diffOp
+		for i, line := range a {
+			ops = append(ops, diffOp{'-', i, 0, line})
+		}
+		for i, line := range b {
+			ops = append(ops, diffOp{'+', n, i, line})
+		}
+		return ops
+	}
+
+	// Backtrack through the trace, collecting the edits in reverse.
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		tv := trace[d]
+		get := func(k int) int { return tv[k+d] }
+		k := x - y
+		var pk int
+		if k == -d || (k != d && get(k-1) < get(k+1)) {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+		px := 0
+		if d > 0 {
+			px = get(pk)
+		}
+		py := px - pk
+		for x > px && y > py {
+			x--
+			y--
+			ops = append(ops, diffOp{' ', x, y, a[x]})
+		}
+		if d > 0 {
+			if x == px {
+				ops = append(ops, diffOp{'+', px, py, b[py]})
+			} else {
+				ops = append(ops, diffOp{'-', px, py, a[px]})
+			}
+		}
+		x, y = px, py
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
@@ -0,0 +1,135 @@
+package progszy
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxZstdWindow is the largest Zstd window size that clients must support,
+// for the zstd content encoding. Browsers reject frames needing more.
+// See RFC 9659.
+const maxZstdWindow = 8 * 1024 * 1024 // 8mb
+
+// negotiateEncoding returns the content encoding to use for a cached body,
+// given the request's Accept-Encoding header: "zstd" (our stored encoding),
+// "gzip" (if allowed, transcoding on the fly), or "" for none.
+func negotiateEncoding(r *http.Request, allowGzip bool) string {
+	ae := r.Header.Get("Accept-Encoding")
+	if len(ae) == 0 {
+		return ""
+	}
+	if acceptsEncoding(ae, "zstd") {
+		return "zstd"
+	}
+	if allowGzip && acceptsEncoding(ae, "gzip") {
+		return "gzip"
+	}
+	return ""
+}
+
+// zstdEncodable reports whether the record's stored body can be sent as is,
+// with the zstd content encoding: that is, its window size is no larger than
+// maxZstdWindow. Bodies stored by earlier versions may have larger windows.
+func zstdEncodable(cr *CacheRecord) bool {
+	zr, err := cr.zstdReader()
+	if err != nil {
+		return false
+	}
+	defer zr.Close()
+	size, err := zstdWindowSize(zr)
+	return err == nil && size <= maxZstdWindow
+}
+
+// zstdWindowSize returns the window size of the Zstd frame read from r,
+// as given by its frame header.
+// See https://datatracker.ietf.org/doc/html/rfc8878#section-3.1.1.1
+func zstdWindowSize(r io.Reader) (uint64, error) {
+	// Magic number, frame header descriptor, and up to 13 more bytes.
+	b := make([]byte, 18)
+	n, err := io.ReadFull(r, b)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	b = b[:n]
+	if len(b) < 6 || binary.LittleEndian.Uint32(b) != 0xfd2fb528 {
+		return 0, errors.New("not a zstd frame")
+	}
+	fhd := b[4]
+	singleSegment := fhd&0x20 != 0
+	if !singleSegment {
+		// The window descriptor follows.
+		exp, mantissa := uint64(b[5]>>3), uint64(b[5]&7)
+		base := uint64(1) << (10 + exp)
+		return base + base/8*mantissa, nil
+	}
+	// Otherwise the window size is the frame content size.
+	i := 5 + []int{0, 1, 2, 4}[fhd&3] // After any dictionary ID.
+	size := []int{1, 2, 4, 8}[fhd>>6]
+	if i+size > len(b) {
+		return 0, errors.New("short zstd frame header")
+	}
+	switch size {
+	case 1:
+		return uint64(b[i]), nil
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(b[i:])) + 256, nil
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(b[i:])), nil
+	}
+	return binary.LittleEndian.Uint64(b[i:]), nil
+}
+
+// weakETag returns the weak form of the given ETag, for a
+// response whose body is encoded differently from the original.
+func weakETag(etag string) string {
+	if len(etag) == 0 || strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return "W/" + etag
+}
+
+// acceptsEncoding reports whether the given Accept-Encoding header value
+// explicitly lists the given encoding, with a non-zero quality value.
+func acceptsEncoding(ae, enc string) bool {
+	for _, f := range strings.Split(ae, ",") {
+		name, params, _ := strings.Cut(f, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), enc) {
+			continue
+		}
+		for _, p := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if ok && k == "q" {
+				q, err := strconv.ParseFloat(v, 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipBody returns a reader over the record's body, transcoded to gzip.
+func gzipBody(cr *CacheRecord) (io.ReadCloser, error) {
+	body, err := cr.Body()
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		// Favour speed, the client is usually local.
+		zw, _ := gzip.NewWriterLevel(pw, gzip.BestSpeed)
+		_, err := io.Copy(zw, body)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(zw.Close())
+	}()
+	return pr, nil
+}
@@ -0,0 +1,120 @@
+package progszy
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// sweepInterval is how often expired records are removed from the cache,
+// and quotas are enforced.
+const sweepInterval = time.Minute
+
+// isExpired reports whether the given record is older than ttl,
+// and should no longer be served. A zero ttl means never.
+func isExpired(cr *CacheRecord, ttl time.Duration) bool {
+	return ttl > 0 && time.Since(storedAt(cr)) > ttl
+}
+
+// storedAt returns the time a record's TTL runs from: when it was
+// created, or else imported (as it was then created long before).
+func storedAt(cr *CacheRecord) time.Time {
+	if !cr.Imported.IsZero() {
+		return cr.Imported
+	}
+	return cr.Created
+}
+
+// recordTTL returns the TTL for the given record. Like the sweeper, this
+// uses the key of the record's bin (from the cache's Binner, as its bin is
+// named for it), which may differ from the record's base domain.
+func (o *options) recordTTL(cr *CacheRecord) time.Duration {
+	key, _, ok := parseBinName(cr.Bin)
+	if !ok {
+		key = cr.BaseDomain
+	}
+	return o.config.ttl(key)
+}
+
+// setExpires sets the X-Cache-Expires header, if the record has a TTL.
+func setExpires(resp *http.Response, cr *CacheRecord, ttl time.Duration) {
+	if ttl > 0 {
+		resp.Header.Set("X-Cache-Expires", storedAt(cr).Add(ttl).UTC().Format(time.RFC3339Nano))
+	}
+}
+
+// sweep removes expired records from the current bin of each base domain,
+// either deleting or archiving them, as configured, in the cache and each
+// of its namespaces. Then, if any quota is exceeded, it evicts the least
+// recently used records. The total quota applies to all namespaces together.
+func sweep(cache Cache, config *Config) error {
+	err := expireBins(cache, config)
+	if err != nil {
+		return err
+	}
+	names, err := cache.Namespaces()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		ns, err := cache.Namespace(name)
+		if err != nil {
+			return err
+		}
+		err = expireBins(ns, config)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !config.hasQuotas() {
+		return nil
+	}
+	n, err := cache.Trim(config.quota, config.totalQuota())
+	if n > 0 {
+		log.Printf("Evicted %d least recently used records", n)
+	}
+	return err
+}
+
+func expireBins(cache Cache, config *Config) error {
+	bins, err := cache.Bins()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, b := range bins {
+		if !b.Current {
+			continue
+		}
+		ttl := config.ttl(b.BaseDomain)
+		if ttl <= 0 {
+			continue
+		}
+		n, err := cache.Expire(b.BaseDomain, now.Add(-ttl), config.Archive)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Printf("Expired %d records for %s", n, b.BaseDomain)
+		}
+	}
+	return nil
+}
+
+// sweepLoop calls sweep every sweepInterval, until stop is closed.
+func sweepLoop(cache Cache, config *Config, stop <-chan struct{}) {
+	t := time.NewTicker(sweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			err := sweep(cache, config)
+			if err != nil {
+				log.Printf("Error sweeping expired records: %v\n", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
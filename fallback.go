@@ -0,0 +1,77 @@
+package progszy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Fallback modes, for misses in the current bin. See WithFallback.
+const (
+	FallbackOff     = ""
+	FallbackCopy    = "copy"
+	FallbackRefetch = "refetch"
+)
+
+// ParseFallback parses a fallback mode: "off", "copy" or "refetch"
+// (in any case). An empty mode is FallbackOff.
+func ParseFallback(v string) (string, error) {
+	switch strings.ToLower(v) {
+	case "", "off":
+		return FallbackOff, nil
+	case FallbackCopy:
+		return FallbackCopy, nil
+	case FallbackRefetch:
+		return FallbackRefetch, nil
+	}
+	return "", fmt.Errorf("invalid fallback mode %q", v)
+}
+
+// fallbackMode returns the fallback mode for the given request.
+func fallbackMode(r *http.Request, o *options) (string, error) {
+	if v := r.Header.Get("X-Cache-Fallback"); len(v) > 0 {
+		mode, err := ParseFallback(v)
+		if err != nil {
+			return "", fmt.Errorf("Invalid X-Cache-Fallback value: %s", v)
+		}
+		return mode, nil
+	}
+	return o.fallback, nil
+}
+
+// staleIfError returns whether a previous copy of the URL
+// may be served for the given request, if upstream fails.
+func staleIfError(r *http.Request, o *options) (bool, error) {
+	switch v := r.Header.Get("X-Cache-Stale-If-Error"); v {
+	case "":
+		mode, _ := fallbackMode(r, o)
+		return o.staleIfError || mode == FallbackRefetch, nil
+	case "TRUE":
+		return true, nil
+	case "FALSE":
+		return false, nil
+	default:
+		return false, fmt.Errorf("Invalid X-Cache-Stale-If-Error value: %s", v)
+	}
+}
+
+// serveStale returns a response serving a previous copy of the given URL,
+// for when upstream fails: either the given stale record (which may be nil),
+// or else the newest previous copy in the cache. If there is no previous
+// copy, it returns nil.
+func serveStale(r *http.Request, uri string, cache Cache, stale *CacheRecord, o *options) *http.Response {
+	cr := stale
+	if cr == nil {
+		var err error
+		cr, err = cache.GetPrevious(uri)
+		if err != nil {
+			if err != ErrCacheMiss {
+				log.Printf("cache.GetPrevious error: %v\n", err)
+			}
+			return nil
+		}
+	}
+	log.Printf("Serving stale copy of %s", uri)
+	return cachedResponse(r, cr, "STALE", o)
+}
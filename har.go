@@ -0,0 +1,291 @@
+package progszy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// See http://www.softwareishard.com/blog/har-12-spec/
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// ExportHAR writes the records of the named bin to w, as a HAR 1.2 file,
+// with an entry for each cached response. Only the response headers are
+// reconstructed (request headers are not cached), and the response time
+// is given as the wait time. Bodies that are not valid UTF-8 are base64
+// encoded.
+func ExportHAR(w io.Writer, cache Cache, bin string) error {
+	// Entries are written one at a time, so only one body is held in memory.
+	_, err := io.WriteString(w, `{"log":{"version":"1.2","creator":{"name":"progszy","version":""},"entries":[`)
+	if err != nil {
+		return err
+	}
+	sep := "\n"
+	err = cache.Walk(bin, func(cr *CacheRecord) error {
+		e, err := newHAREntry(cr)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, sep)
+		if err == nil {
+			_, err = w.Write(b)
+		}
+		sep = ",\n"
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n]}}\n")
+	return err
+}
+
+// newHAREntry returns a HAR entry for the cache record.
+func newHAREntry(cr *CacheRecord) (*harEntry, error) {
+	r, err := cr.Body()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	proto := cr.Protocol
+	if len(proto) == 0 {
+		proto = "HTTP/1.1"
+	}
+	query := []harNameValue{}
+	u, err := url.Parse(cr.URL)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range strings.Split(u.RawQuery, "&") {
+		if len(p) == 0 {
+			continue
+		}
+		name, value, _ := strings.Cut(p, "=")
+		name, _ = url.QueryUnescape(name)
+		value, _ = url.QueryUnescape(value)
+		query = append(query, harNameValue{name, value})
+	}
+	headers := []harNameValue{}
+	for _, f := range responseHeaders(cr) {
+		headers = append(headers, harNameValue{f.name, f.value})
+	}
+
+	e := &harEntry{
+		StartedDateTime: cr.Created,
+		Time:            cr.ResponseTime,
+		Request: harRequest{
+			Method:      http.MethodGet,
+			URL:         cr.URL,
+			HTTPVersion: proto,
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			QueryString: query,
+			HeadersSize: -1,
+			BodySize:    0,
+		},
+		Response: harResponse{
+			Status:      cr.Status,
+			StatusText:  http.StatusText(cr.Status),
+			HTTPVersion: proto,
+			Cookies:     []harNameValue{},
+			Headers:     headers,
+			Content: harContent{
+				Size:     cr.ContentLength,
+				MimeType: cr.ContentType,
+			},
+			RedirectURL: cr.Location,
+			HeadersSize: -1,
+			BodySize:    cr.ContentLength,
+		},
+		Timings: harTimings{Wait: cr.ResponseTime},
+	}
+	if utf8.Valid(body) {
+		e.Response.Content.Text = string(body)
+	} else {
+		e.Response.Content.Text = base64.StdEncoding.EncodeToString(body)
+		e.Response.Content.Encoding = "base64"
+	}
+	return e, nil
+}
+
+// ImportHAR reads the entries of a HAR file from r, and puts their responses
+// in the cache, keeping their original start time, and their total time as
+// the response time. Only GET requests answered with the given status codes
+// are imported (default is 200 only), and entries without any content
+// (as some browsers omit it) are skipped. URLs already in the cache are
+// left unchanged. It returns the number of entries imported. As with
+// ImportWARC, any TTL runs from the import time, not the start time.
+func ImportHAR(r io.Reader, cache Cache, cacheable ...int) (int, error) {
+	if len(cacheable) == 0 {
+		cacheable = []int{http.StatusOK}
+	}
+	statuses := newStatusSet(cacheable...)
+
+	var har harFile
+	err := json.NewDecoder(r).Decode(&har)
+	if err != nil {
+		return 0, err
+	}
+
+	imported := time.Now()
+	n := 0
+	for i := range har.Log.Entries {
+		e := &har.Log.Entries[i]
+		if e.Request.Method != http.MethodGet || !statuses.has(e.Response.Status) {
+			continue
+		}
+		cr, err := harCacheRecord(e)
+		if err != nil {
+			log.Printf("Skipping HAR entry for %s: %v\n", e.Request.URL, err)
+			continue
+		}
+		cr.Imported = imported
+		err = cache.Put(cr)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// harCacheRecord returns a CacheRecord for the response of a HAR entry.
+func harCacheRecord(e *harEntry) (*CacheRecord, error) {
+	c := e.Response.Content
+	if len(c.Text) == 0 && c.Size > 0 {
+		return nil, errors.New("no content")
+	}
+	body := []byte(c.Text)
+	if c.Encoding == "base64" {
+		var err error
+		body, err = base64.StdEncoding.DecodeString(c.Text)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(c.Encoding) > 0 {
+		return nil, fmt.Errorf("unsupported content encoding %q", c.Encoding)
+	}
+
+	header := func(name string) string {
+		for _, h := range e.Response.Headers {
+			if strings.EqualFold(h.Name, name) {
+				return h.Value
+			}
+		}
+		return ""
+	}
+	proto := harProtocol(e.Response.HTTPVersion)
+	lang := header("Content-Language")
+	mime := c.MimeType
+	if len(mime) == 0 {
+		mime = header("Content-Type")
+	}
+	etag := header("ETag")
+	lastMod := header("Last-Modified")
+	cr, err := NewCacheRecord(e.Request.URL, e.Response.Status, proto, lang, mime, etag, lastMod, body, max(e.Time, 0), e.StartedDateTime)
+	if err != nil {
+		return nil, err
+	}
+	if isRedirect(cr.Status) {
+		cr.Location = header("Location")
+		if len(cr.Location) == 0 {
+			cr.Location = e.Response.RedirectURL
+		}
+	}
+	return cr, nil
+}
+
+// harProtocol normalises the HTTP version of a HAR response,
+// as browsers report HTTP/2 and HTTP/3 in various ways.
+func harProtocol(v string) string {
+	switch strings.ToLower(v) {
+	case "":
+		return ""
+	case "h2", "http/2", "http/2.0":
+		return "HTTP/2.0"
+	case "h3", "http/3", "http/3.0":
+		return "HTTP/3.0"
+	}
+	return strings.ToUpper(v)
+}
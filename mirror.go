@@ -0,0 +1,203 @@
+package progszy
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// fsIndexFile is the name of the index file written by ExportFS.
+const fsIndexFile = "index.jsonl"
+
+// fsDirIndexFile is the filename used for URLs ending in a slash.
+const fsDirIndexFile = "index.html"
+
+// maxFSNameLen limits the length of each filename written by ExportFS.
+// Longer names are truncated, and given a hash to keep them unique.
+const maxFSNameLen = 200
+
+// fsIndexEntry is a line of the index file written by ExportFS.
+type fsIndexEntry struct {
+	Path string `json:"path"`
+	*recordInfo
+}
+
+// ExportFS writes the records of the named bin to a tree of files in dir,
+// which must be empty (or not yet exist). Each record's uncompressed body
+// is written to a path derived from its normalised URL, e.g.
+//
+//	http://example.com/a/b?q=1 -> http/example.com/a/b%3Fq%3D1
+//	http://example.com/a/      -> http/example.com/a/index.html
+//
+// Any characters other than letters, digits, '.', '-' and '_' are escaped,
+// as %XX. Where paths clash, e.g. when both /a and /a/b are cached, a suffix
+// of ~1, ~2, etc. is added to make them unique. An index file, index.jsonl,
+// holds a line of JSON for each record, with its path, URL and metadata.
+func ExportFS(dir string, cache Cache, bin string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("directory %s is not empty", dir)
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(dir, fsIndexFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bw)
+
+	t := newFSTree()
+	err = cache.Walk(bin, func(cr *CacheRecord) error {
+		p, err := t.path(cr.Key)
+		if err != nil {
+			return err
+		}
+		err = writeFSFile(filepath.Join(dir, filepath.FromSlash(p)), cr)
+		if err != nil {
+			return err
+		}
+		return enc.Encode(fsIndexEntry{p, newRecordInfo(cr)})
+	})
+	if err != nil {
+		return err
+	}
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeFSFile writes the uncompressed body of cr to the named file.
+func writeFSFile(name string, cr *CacheRecord) error {
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+	r, err := cr.Body()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// fsTree maps URLs to unique slash separated paths, for ExportFS.
+type fsTree struct {
+	// dirs maps the path of each directory (as derived from URLs)
+	// to the path actually used for it.
+	dirs map[string]string
+	// taken holds the paths used by files and directories.
+	taken map[string]bool
+}
+
+func newFSTree() *fsTree {
+	return &fsTree{
+		dirs:  make(map[string]string),
+		taken: make(map[string]bool),
+	}
+}
+
+// path returns a new path for the given normalised URL.
+func (t *fsTree) path(nurl string) (string, error) {
+	u, err := url.Parse(nurl)
+	if err != nil {
+		return "", err
+	}
+	names := []string{escapeFSName(u.Scheme), escapeFSName(u.Host)}
+	segs := strings.Split(strings.TrimPrefix(u.EscapedPath(), "/"), "/")
+	for _, seg := range segs {
+		s, err := url.PathUnescape(seg)
+		if err != nil {
+			s = seg
+		}
+		names = append(names, escapeFSName(s))
+	}
+	leaf := names[len(names)-1]
+	if len(u.RawQuery) > 0 {
+		leaf += escapeFSName("?" + u.RawQuery)
+	} else if len(leaf) == 0 {
+		leaf = fsDirIndexFile
+	}
+	leaf = truncateFSName(leaf)
+
+	// Find (or reserve) each directory on the path.
+	dir := ""
+	for i := range names[:len(names)-1] {
+		key := strings.Join(names[:i+1], "/")
+		p, ok := t.dirs[key]
+		if !ok {
+			p = t.reserve(path.Join(dir, truncateFSName(names[i])))
+			t.dirs[key] = p
+		}
+		dir = p
+	}
+	return t.reserve(path.Join(dir, leaf)), nil
+}
+
+// reserve returns the given path, or if it is already
+// taken, the path with a suffix, marking it as taken.
+func (t *fsTree) reserve(p string) string {
+	q := p
+	for i := 1; t.taken[q]; i++ {
+		q = p + "~" + strconv.Itoa(i)
+	}
+	t.taken[q] = true
+	return q
+}
+
+// escapeFSName escapes any characters in s that are not letters,
+// digits, '.', '-' or '_', as %XX, making it a safe filename.
+func escapeFSName(s string) string {
+	if s == "." || s == ".." {
+		return strings.Repeat("%2E", len(s))
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '.', c == '-', c == '_':
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// truncateFSName truncates overly long filenames, adding a hash
+// of the whole name, so they remain unique.
+func truncateFSName(s string) string {
+	if len(s) <= maxFSNameLen {
+		return s
+	}
+	h := md5.Sum([]byte(s))
+	return s[:maxFSNameLen-9] + "~" + hex.EncodeToString(h[:4])
+}
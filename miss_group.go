@@ -0,0 +1,42 @@
+package progszy
+
+import "sync"
+
+// missGroup tracks in-flight cache misses, so that concurrent
+// misses for the same key can wait for a single upstream fetch.
+type missGroup struct {
+	mu       sync.Mutex
+	inFlight map[string]chan struct{}
+}
+
+func newMissGroup() *missGroup {
+	g := missGroup{
+		inFlight: make(map[string]chan struct{}),
+	}
+	return &g
+}
+
+// join reports whether the caller is the leader for the given key.
+// The leader must call the returned done func once its fetch is complete.
+// Other callers block until the leader is done, and get a nil done func.
+func (g *missGroup) join(key string) (func(), bool) {
+	g.mu.Lock()
+	ch, ok := g.inFlight[key]
+	if ok {
+		// Wait for the leader.
+		g.mu.Unlock()
+		<-ch
+		return nil, false
+	}
+	ch = make(chan struct{})
+	g.inFlight[key] = ch
+	g.mu.Unlock()
+
+	done := func() {
+		g.mu.Lock()
+		delete(g.inFlight, key)
+		g.mu.Unlock()
+		close(ch)
+	}
+	return done, true
+}
@@ -0,0 +1,165 @@
+package progszy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Option configures optional proxy behaviour.
+type Option func(*options)
+
+type options struct {
+	// cacheable holds the upstream status codes that get stored in the cache.
+	cacheable statusSet
+	// offline prevents upstream requests, for replay-only operation.
+	offline bool
+	// config holds global and per base domain settings.
+	config *Config
+	// maxAge is the age at which a cached response is revalidated
+	// with upstream. Negative means never.
+	maxAge time.Duration
+	// gzip enables transcoding cached bodies to gzip,
+	// for clients that accept gzip but not zstd.
+	gzip bool
+	// adminAddr is the address for Run to serve the admin REST API on, if any.
+	adminAddr string
+	// fallback is how cache misses use older bins, if at all.
+	fallback string
+	// staleIfError serves a previous copy of a URL when upstream fails.
+	staleIfError bool
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		cacheable: newStatusSet(http.StatusOK),
+		maxAge:    -1,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.config == nil {
+		o.config = &Config{}
+	}
+	return o
+}
+
+// WithCacheableStatus sets the default list of upstream status codes
+// whose responses are stored in the cache (default is 200 only).
+// Individual requests may override this via an X-Cache-Cacheable header.
+func WithCacheableStatus(codes ...int) Option {
+	return func(o *options) {
+		o.cacheable = newStatusSet(codes...)
+	}
+}
+
+// WithOffline sets whether the proxy is offline, and never makes upstream requests:
+// cache misses instead return a 504 Gateway Timeout. Individual requests may
+// override this via an X-Cache-Mode header.
+func WithOffline(offline bool) Option {
+	return func(o *options) {
+		o.offline = offline
+	}
+}
+
+// WithConfig sets the global and per base domain settings,
+// such as upstream rate limits.
+func WithConfig(config *Config) Option {
+	return func(o *options) {
+		o.config = config
+	}
+}
+
+// WithMaxAge sets the default age at which a cached response becomes stale,
+// and is revalidated with upstream before being served. A negative age
+// (the default) disables revalidation. Individual requests may override
+// this via an X-Cache-Max-Age header.
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(o *options) {
+		o.maxAge = maxAge
+	}
+}
+
+// WithGzip sets whether cache hits are transcoded to gzip, for clients
+// that accept gzip but not zstd (default is false). Clients that accept
+// zstd are always sent the stored Zstd compressed body, as is.
+func WithGzip(gzip bool) Option {
+	return func(o *options) {
+		o.gzip = gzip
+	}
+}
+
+// WithAdmin sets the address (e.g. ":5596") on which Run serves the admin
+// REST API, for cache management (see AdminHandler). By default it is not served.
+func WithAdmin(addr string) Option {
+	return func(o *options) {
+		o.adminAddr = addr
+	}
+}
+
+// WithFallback sets how misses in the current bin use previous copies of
+// the URL, from older bins: FallbackCopy copies the newest previous copy
+// forward into the current bin, and serves it, FallbackRefetch fetches from
+// upstream as usual, but serves the newest previous copy if that fails.
+// By default (FallbackOff) older bins are not used. Individual requests
+// may override this via an X-Cache-Fallback header.
+func WithFallback(mode string) Option {
+	return func(o *options) {
+		o.fallback = mode
+	}
+}
+
+// WithStaleIfError sets whether a previous copy of a URL is served when
+// fetching it from upstream fails (default is false). Individual requests
+// may override this via an X-Cache-Stale-If-Error header.
+func WithStaleIfError(staleIfError bool) Option {
+	return func(o *options) {
+		o.staleIfError = staleIfError
+	}
+}
+
+// statusSet is a set of HTTP status codes.
+type statusSet map[int]bool
+
+func newStatusSet(codes ...int) statusSet {
+	s := make(statusSet, len(codes))
+	for _, c := range codes {
+		s[c] = true
+	}
+	return s
+}
+
+func (s statusSet) has(code int) bool {
+	return s[code]
+}
+
+// ParseStatusCodes parses a comma separated list of HTTP status codes,
+// such as "200,404,410". A class of codes can be given using the form "3xx".
+func ParseStatusCodes(list string) ([]int, error) {
+	var codes []int
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) == 3 && strings.HasSuffix(strings.ToLower(f), "xx") && f[0] >= '1' && f[0] <= '5' {
+			// Status class.
+			base := int(f[0]-'0') * 100
+			for c := base; c < base+100; c++ {
+				codes = append(codes, c)
+			}
+			continue
+		}
+		c, err := strconv.Atoi(f)
+		if err != nil || c < 100 || c > 599 {
+			return nil, fmt.Errorf("invalid status code %q", f)
+		}
+		codes = append(codes, c)
+	}
+	if len(codes) == 0 {
+		return nil, fmt.Errorf("no status codes in %q", list)
+	}
+	return codes, nil
+}
@@ -0,0 +1,321 @@
+package progszy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
+)
+
+// politeness holds the per base domain limits on upstream requests.
+type politeness struct {
+	config *Config
+	mu     sync.Mutex
+	byHost map[string]*hostLimiter
+}
+
+func newPoliteness(config *Config) *politeness {
+	if config == nil {
+		config = &Config{}
+	}
+	p := politeness{
+		config: config,
+		byHost: make(map[string]*hostLimiter),
+	}
+	return &p
+}
+
+// limiter returns the limiter for the given base domain.
+func (p *politeness) limiter(bd string) *hostLimiter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, ok := p.byHost[bd]
+	if !ok {
+		dc := p.config.domain(bd)
+		// Rate and max backoff have already been validated.
+		rate, _ := ParseRate(dc.Rate)
+		maxBackoff, _ := ParseMaxBackoff(dc.MaxBackoff)
+		l = newHostLimiter(rate, dc.Burst, dc.MaxInFlight, maxBackoff)
+		p.byHost[bd] = l
+	}
+	return l
+}
+
+// hostLimiter is a token bucket rate limiter,
+// combined with a limit on concurrent requests,
+// and a shared backoff state.
+type hostLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens per second, zero is unlimited.
+	burst  float64
+	tokens float64
+	last   time.Time
+	// slots limits concurrent requests, nil is unlimited.
+	slots chan struct{}
+	// pausedUntil is when requests may resume, after the host signalled overload.
+	pausedUntil time.Time
+	// failures counts consecutive overload responses.
+	failures int
+	// maxBackoff limits the pause given by a Retry-After, zero is unlimited.
+	maxBackoff time.Duration
+	// sent is when the latest request was (or is due to be) sent.
+	sent time.Time
+}
+
+func newHostLimiter(rate float64, burst, maxInFlight int, maxBackoff time.Duration) *hostLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	l := hostLimiter{
+		rate:       rate,
+		burst:      float64(burst),
+		tokens:     float64(burst),
+		last:       time.Now(),
+		maxBackoff: maxBackoff,
+	}
+	if maxInFlight > 0 {
+		l.slots = make(chan struct{}, maxInFlight)
+	}
+	return &l
+}
+
+// space returns how long the caller must wait before sending a request,
+// so that it is sent no sooner than the given interval after the previous
+// request, and records when it will be sent.
+func (l *hostLimiter) space(interval time.Duration) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	at := now
+	if next := l.sent.Add(interval); next.After(now) {
+		at = next
+	}
+	l.sent = at
+	return at.Sub(now)
+}
+
+// refill adds the tokens accrued since last time.
+// (Assumes the mutex is already locked.)
+func (l *hostLimiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+}
+
+// reserve takes a token, returning how long the caller must wait before using it.
+func (l *hostLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refill(time.Now())
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// pause returns how long until requests may resume.
+func (l *hostLimiter) pause() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Until(l.pausedUntil)
+}
+
+// backoff pauses all requests to the host, after an overload response.
+// If the host gave no Retry-After, the pause increases exponentially
+// with consecutive overload responses. A Retry-After is limited to
+// maxBackoff, so a buggy (or hostile) host can't pause requests indefinitely.
+func (l *hostLimiter) backoff(retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failures++
+	d := retryAfter
+	if l.maxBackoff > 0 && d > l.maxBackoff {
+		d = l.maxBackoff
+	}
+	if d <= 0 {
+		d = defaultRetryWaitMin << (l.failures - 1)
+		if d > defaultRetryWaitMax || d <= 0 {
+			d = defaultRetryWaitMax
+		}
+	}
+	until := time.Now().Add(d)
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// recover resets the backoff state, after a successful response.
+func (l *hostLimiter) recover() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failures = 0
+}
+
+// acquire blocks until a request may be made, returning a func
+// to release its concurrency slot, and the time spent waiting.
+// If the context holds a request rate (see requestRateKey), the
+// request is also spaced out from the previous request accordingly.
+func (l *hostLimiter) acquire(ctx context.Context) (func(), time.Duration, error) {
+	start := time.Now()
+	// Wait out any backoff (which may be extended while we wait).
+	for d := l.pause(); d > 0; d = l.pause() {
+		err := sleep(ctx, d)
+		if err != nil {
+			return nil, time.Since(start), err
+		}
+	}
+	release := func() {}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, time.Since(start), ctx.Err()
+		}
+		var once sync.Once
+		release = func() {
+			once.Do(func() { <-l.slots })
+		}
+	}
+	err := sleep(ctx, l.reserve())
+	if err != nil {
+		release()
+		return nil, time.Since(start), err
+	}
+	var interval time.Duration
+	if rate, ok := ctx.Value(requestRateKey).(float64); ok && rate > 0 {
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+	err = sleep(ctx, l.space(interval))
+	if err != nil {
+		release()
+		return nil, time.Since(start), err
+	}
+	return release, time.Since(start), nil
+}
+
+// sleep pauses for the given duration, or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// politeTransport applies the per base domain limits to each upstream request.
+type politeTransport struct {
+	base http.RoundTripper
+	p    *politeness
+}
+
+func (t *politeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	bd, err := BaseDomainName(req.URL)
+	if err != nil {
+		// Not a domain we can limit.
+		return t.base.RoundTrip(req)
+	}
+	l := t.p.limiter(bd)
+	release, waited, err := l.acquire(req.Context())
+	addUpstreamWait(req.Context(), waited)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if isOverloaded(resp.StatusCode) {
+		l.backoff(retryAfter(resp.Header.Get("Retry-After")))
+	} else {
+		l.recover()
+	}
+	// Hold the concurrency slot until the body is closed.
+	resp.Body = &releaseReadCloser{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releaseReadCloser struct {
+	io.ReadCloser
+	release func()
+}
+
+func (rc *releaseReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.release()
+	return err
+}
+
+// isOverloaded reports whether the status code signals that the host is overloaded.
+func isOverloaded(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// retryAfter parses a Retry-After header value,
+// either in seconds or an HTTP date. It returns zero if absent or invalid.
+func retryAfter(v string) time.Duration {
+	if len(v) == 0 {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// backoff is the retry backoff policy. The wait after an overload response
+// is instead handled by the host's shared backoff state, in politeTransport.
+func backoff(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	if resp != nil && isOverloaded(resp.StatusCode) {
+		return 0
+	}
+	return retryablehttp.DefaultBackoff(min, max, attemptNum, resp)
+}
+
+// upstreamWaitKey is the context key for a request's *upstreamWait.
+const upstreamWaitKey contextKey = 1
+
+// requestRateKey is the context key for a request's own rate limit,
+// in requests per second, as given by its X-Cache-Rate header.
+const requestRateKey contextKey = 2
+
+// upstreamWait accumulates the time a request spends waiting on politeness limits.
+type upstreamWait struct {
+	mu  sync.Mutex
+	dur time.Duration
+}
+
+func (w *upstreamWait) get() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dur
+}
+
+func addUpstreamWait(ctx context.Context, d time.Duration) {
+	if w, ok := ctx.Value(upstreamWaitKey).(*upstreamWait); ok {
+		w.mu.Lock()
+		w.dur += d
+		w.mu.Unlock()
+	}
+}
@@ -3,12 +3,15 @@ package progszy
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -31,14 +34,16 @@ const maxBodySize = 512 * 1024 * 1024 // 512mb
 // const maxBodySize = 16 * 1024 * 1024 // 16mb
 // const maxBodySize = 1 * 1024 * 1024 // 1mb
 
-func ProxyHandlerWith(cache Cache, proxy *url.URL) http.Handler {
+// ProxyHandlerWith returns an HTTP(S) proxy handler that uses the given cache,
+// making any upstream requests via the given proxy (which may be nil).
+func ProxyHandlerWith(cache Cache, proxy *url.URL, opts ...Option) http.Handler {
 
 	p := goproxy.NewProxyHttpServer()
 	// TODO Control goproxy logging from outside.
 	// proxy.Verbose = true
 	p.OnRequest().HandleConnect(goproxy.AlwaysMitm)
 
-	handler := proxyHandler(cache, proxy)
+	handler := proxyHandler(cache, proxy, newOptions(opts))
 
 	p.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 		return nil, handler(req)
@@ -51,7 +56,7 @@ func ProxyHandlerWith(cache Cache, proxy *url.URL) http.Handler {
 
 // ----------------------------
 
-func proxyHandler(cache Cache, proxy *url.URL) func(*http.Request) *http.Response {
+func proxyHandler(cache Cache, proxy *url.URL, o *options) func(*http.Request) *http.Response {
 
 	// Parse incoming HTTP request.
 	// Get requested URL.
@@ -64,7 +69,8 @@ func proxyHandler(cache Cache, proxy *url.URL) func(*http.Request) *http.Respons
 	// Store response in cache.
 	// Return response.
 
-	handleCacheMiss := makeCacheMissHandler(proxy)
+	handleCacheMiss := makeCacheMissHandler(proxy, o)
+	misses := newMissGroup()
 
 	return func(r *http.Request) *http.Response {
 
@@ -119,6 +125,14 @@ func proxyHandler(cache Cache, proxy *url.URL) func(*http.Request) *http.Respons
 
 		// log.Printf("============requested uri %s", uri)
 
+		// Use the requested namespace, if any.
+		ns := r.Header.Get("X-Cache-Namespace")
+		cache, err := cache.Namespace(ns)
+		if err != nil {
+			m := fmt.Sprintf("Invalid X-Cache-Namespace value: %s", ns)
+			return httpError(r, m, http.StatusBadRequest)
+		}
+
 		if r.Header.Get("X-Cache-Flush") == "TRUE" {
 			err := cache.Flush(uri)
 			if err != nil {
@@ -130,53 +144,319 @@ func proxyHandler(cache Cache, proxy *url.URL) func(*http.Request) *http.Respons
 			return resp
 		}
 
+		if v := r.Header.Get("X-Cache-Evict"); len(v) > 0 {
+			return evict(r, uri, v, cache)
+		}
+
+		offline := o.offline
+		switch mode := r.Header.Get("X-Cache-Mode"); mode {
+		case "":
+			// Use default.
+		case "OFFLINE":
+			offline = true
+		case "ONLINE":
+			offline = false
+		default:
+			m := fmt.Sprintf("Invalid X-Cache-Mode value: %s", mode)
+			return httpError(r, m, http.StatusBadRequest)
+		}
+
+		maxAge := o.maxAge
+		if v := r.Header.Get("X-Cache-Max-Age"); len(v) > 0 {
+			var err error
+			maxAge, err = parseMaxAge(v)
+			if err != nil {
+				return httpError(r, err.Error(), http.StatusBadRequest)
+			}
+		}
+
+		// Serve from a bin as it was at the given time, never contacting upstream.
+		if v := r.Header.Get("X-Cache-As-Of"); len(v) > 0 {
+			asOf, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				m := fmt.Sprintf("Invalid X-Cache-As-Of value: %s", v)
+				return httpError(r, m, http.StatusBadRequest)
+			}
+			cr, err := cache.GetAsOf(uri, asOf)
+			if err == ErrCacheMiss {
+				m := fmt.Sprintf("As of cache miss %s", uri)
+				resp := httpError(r, m, http.StatusGatewayTimeout)
+				resp.Header.Set("X-Cache", "MISS-OFFLINE")
+				return resp
+			}
+			if err != nil {
+				log.Printf("cache.GetAsOf error: %v\n", err)
+				return httpError(r, fmt.Sprint(err), http.StatusInternalServerError)
+			}
+			return cachedResponse(r, cr, "HIT", o)
+		}
+
+		fallback, err := fallbackMode(r, o)
+		if err != nil {
+			return httpError(r, err.Error(), http.StatusBadRequest)
+		}
+
 		// Try to get from cache.
+		hit := "HIT"
 		cr, err := cache.Get(uri)
-		if err == nil {
+		if err == ErrCacheMiss && fallback == FallbackCopy {
+			// Copy the newest previous copy forward, into the current bin.
+			prev, err2 := cache.GetPrevious(uri)
+			if err2 == nil {
+				err2 = cache.Put(prev)
+			}
+			if err2 == nil {
+				cr, err, hit = prev, nil, "FALLBACK"
+			} else if err2 != ErrCacheMiss {
+				err = err2
+			}
+		}
+		if err != nil && err != ErrCacheMiss {
+			log.Printf("cache.Get error: %v\n", err)
+			return httpError(r, fmt.Sprint(err), http.StatusInternalServerError)
+		}
+		if err == nil && !isExpired(cr, o.recordTTL(cr)) {
 			// Cache hit.
 			// log.Println("cache hit")
-
-			resp := newResponse(r, http.StatusOK)
-			resp.Header.Set("X-Cache", "HIT")
-			applyCommonHeaders(resp, cr)
-
-			switch r.Method {
-			case http.MethodGet:
-				resp.Body, err = cr.Body()
-				if err != nil {
-					log.Printf("Cache body error during GET: %v\n", err)
-					return httpError(r, fmt.Sprint(err), http.StatusInternalServerError)
-				}
-				log.Printf("decompressed content size %s", byteCountDecimal(cr.ContentLength))
-			case http.MethodHead:
-				// No action.
+			if offline || !isStale(cr, maxAge) {
+				return cachedResponse(r, cr, hit, o)
 			}
+			// Stale, so revalidate it with upstream.
+		} else if offline {
+			// Never contact upstream.
+			m := fmt.Sprintf("Offline cache miss %s", uri)
+			resp := httpError(r, m, http.StatusGatewayTimeout)
+			resp.Header.Set("X-Cache", "MISS-OFFLINE")
 			return resp
 		}
-		if err != ErrCacheMiss {
+		// (An expired record is also revalidated, it may yet be unchanged.)
+
+		// Coalesce concurrent misses (and revalidations) for the same URL: only
+		// the leader fetches from upstream, the others then get it from the cache.
+		key, _, err := cacheRecordKey(uri)
+		if err != nil {
+			m := fmt.Sprintf("URL parse error %s", uri)
+			return httpError(r, m, http.StatusBadRequest)
+		}
+		joined := time.Now()
+		done, leader := misses.join(ns + " " + key)
+		if leader {
+			defer done()
+			return handleCacheMiss(r, uri, cache, cr)
+		}
+		// A record the leader stored (or refreshed) while we waited is fresh,
+		// whatever our max age, else every follower would fetch it again.
+		cr, err = cache.Get(uri)
+		if err == nil && (cr.Created.After(joined) || !isStale(cr, maxAge)) && !isExpired(cr, o.recordTTL(cr)) {
+			return cachedResponse(r, cr, "COALESCED", o)
+		}
+		if err != nil && err != ErrCacheMiss {
 			log.Printf("cache.Get error: %v\n", err)
 			return httpError(r, fmt.Sprint(err), http.StatusInternalServerError)
 		}
+		// The leader's response was not cached, so fetch it ourselves.
+
+		return handleCacheMiss(r, uri, cache, cr)
+	}
+}
+
+// evict removes the given URL from the cache, or with X-Cache-Evict: PREFIX,
+// all URLs starting with it, or with X-Cache-Evict: REGEX, all URLs
+// in its bin matching the X-Cache-Evict-Pattern header.
+func evict(r *http.Request, uri, mode string, cache Cache) *http.Response {
+	key, _, err := cacheRecordKey(uri)
+	if err != nil {
+		m := fmt.Sprintf("URL parse error %s", uri)
+		return httpError(r, m, http.StatusBadRequest)
+	}
+	n := 0
+	var match func(string) bool
+	switch mode {
+	case "TRUE":
+		// Just this URL.
+	case "PREFIX":
+		match = func(k string) bool { return strings.HasPrefix(k, key) }
+	case "REGEX":
+		re, err := regexp.Compile(r.Header.Get("X-Cache-Evict-Pattern"))
+		if err != nil {
+			m := fmt.Sprintf("Unable to compile X-Cache-Evict-Pattern: %v", err)
+			return httpError(r, m, http.StatusBadRequest)
+		}
+		match = re.MatchString
+	default:
+		m := fmt.Sprintf("Invalid X-Cache-Evict value: %s", mode)
+		return httpError(r, m, http.StatusBadRequest)
+	}
+	if match == nil {
+		err = cache.Delete(uri)
+		if err == nil {
+			n = 1
+		} else if err == ErrCacheMiss {
+			err = nil
+		}
+	} else {
+		n, err = cache.DeleteMatching(uri, match)
+	}
+	if err != nil {
+		m := fmt.Sprintf("Cache evict error %s", err)
+		return httpError(r, m, http.StatusInternalServerError)
+	}
+	log.Printf("Evicted %d URLs for %s", n, uri)
+	resp := newResponse(r, http.StatusOK)
+	resp.Header.Set("X-Cache", "EVICTED")
+	resp.Header.Set("X-Cache-Evicted", strconv.Itoa(n))
+	return resp
+}
+
+// cachedResponse returns a response for the given cache record,
+// with the given X-Cache header value. Client conditional requests
+// and Range requests are answered from the record. Otherwise, the body
+// is sent Zstd (or gzip) encoded, if the client accepts it.
+func cachedResponse(r *http.Request, cr *CacheRecord, xcache string, o *options) *http.Response {
+	if cr.Status == http.StatusOK {
+		if notModified(r, cr) {
+			resp := newResponse(r, http.StatusNotModified)
+			applyHitHeaders(resp, cr, xcache, o)
+			resp.Header.Del("Content-Length")
+			resp.Header.Del("Content-Type")
+			return resp
+		}
+		if v := r.Header.Get("Range"); len(v) > 0 && rangeApplies(r, cr) {
+			if resp := rangeResponse(r, cr, v, xcache, o); resp != nil {
+				return resp
+			}
+		}
+	}
 
-		return handleCacheMiss(r, uri, cache)
+	resp := newResponse(r, cr.Status)
+	applyHitHeaders(resp, cr, xcache, o)
+	if cr.Status == http.StatusOK {
+		resp.Header.Set("Accept-Ranges", "bytes")
+	}
+
+	encoding := negotiateEncoding(r, o.gzip)
+	if encoding == "zstd" && !zstdEncodable(cr) {
+		// Clients can't decode it as is, so decode it (or transcode it) instead.
+		encoding = ""
+		if o.gzip && acceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip") {
+			encoding = "gzip"
+		}
 	}
+	resp.Header.Set("Vary", "Accept-Encoding")
+	if len(encoding) > 0 && len(cr.ETag) > 0 {
+		// The encoded body is not byte for byte the same as the original.
+		resp.Header.Set("ETag", weakETag(cr.ETag))
+	}
+	switch encoding {
+	case "zstd":
+		resp.Header.Set("Content-Encoding", "zstd")
+		resp.Header.Set("Content-Length", strconv.FormatInt(cr.CompressedLength, 10))
+	case "gzip":
+		resp.Header.Set("Content-Encoding", "gzip")
+		// Length is unknown until transcoded.
+		resp.Header.Del("Content-Length")
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		switch encoding {
+		case "zstd":
+			// Pass the stored body straight through.
+			resp.Body, err = cr.zstdReader()
+		case "gzip":
+			resp.Body, err = gzipBody(cr)
+		default:
+			resp.Body, err = cr.Body()
+		}
+		if err != nil {
+			log.Printf("Cache body error during GET: %v\n", err)
+			return httpError(r, fmt.Sprint(err), http.StatusInternalServerError)
+		}
+		if encoding == "zstd" {
+			log.Printf("compressed content size %s", byteCountDecimal(cr.CompressedLength))
+		} else {
+			log.Printf("decompressed content size %s", byteCountDecimal(cr.ContentLength))
+		}
+	case http.MethodHead:
+		// No action.
+	}
+	return resp
 }
 
-func makeCacheMissHandler(proxy *url.URL) func(r *http.Request, uri string, cache Cache) *http.Response {
+// makeCacheMissHandler returns a handler that fetches the given URL from upstream,
+// and stores the response in the cache. If a stale record is given, the upstream
+// request is made conditional, and the stale record is either refreshed or replaced.
+func makeCacheMissHandler(proxy *url.URL, o *options) func(r *http.Request, uri string, cache Cache, stale *CacheRecord) *http.Response {
 
 	rulesCache := newRulesMap()
-	secureClient := newClient(false, proxy)
-	insecureClient := newClient(true, proxy)
+	polite := newPoliteness(o.config)
+	secureClient := newClient(false, proxy, polite)
+	insecureClient := newClient(true, proxy, polite)
 
-	return func(r *http.Request, uri string, cache Cache) *http.Response {
+	fetch := func(r *http.Request, uri string, cache Cache, stale *CacheRecord, wait *upstreamWait) *http.Response {
 
 		// Cache miss - fetch and cache.
 
-		resp := newResponse(r, http.StatusOK)
-		resp.Header.Set("X-Cache", "MISS")
-
 		// log.Println("cache miss")
 
+		cacheable := o.cacheable
+		if v := r.Header.Get("X-Cache-Cacheable"); len(v) > 0 {
+			codes, err := ParseStatusCodes(v)
+			if err != nil {
+				m := fmt.Sprintf("Invalid X-Cache-Cacheable value: %v", err)
+				return httpError(r, m, http.StatusBadRequest)
+			}
+			cacheable = newStatusSet(codes...)
+		}
+
+		// A rate only applies to this request, the configured limits still apply.
+		var rate float64
+		if v := r.Header.Get("X-Cache-Rate"); len(v) > 0 {
+			var err error
+			rate, err = ParseRate(v)
+			if err != nil {
+				m := fmt.Sprintf("Invalid X-Cache-Rate value: %v", err)
+				return httpError(r, m, http.StatusBadRequest)
+			}
+		}
+
+		staleOK, err := staleIfError(r, o)
+		if err != nil {
+			return httpError(r, err.Error(), http.StatusBadRequest)
+		}
+		// upstreamFailed returns a previous copy of the URL, if allowed
+		// and available, otherwise the given error response.
+		upstreamFailed := func(resp *http.Response) *http.Response {
+			if staleOK {
+				if s := serveStale(r, uri, cache, stale, o); s != nil {
+					return s
+				}
+			}
+			return resp
+		}
+
+		// Get appropriately configured client.
+		client := secureClient
+		if r.Header.Get("X-Cache-SSL") == "INSECURE" {
+			client = insecureClient
+		}
+		client, err = requestClient(client, r.Header)
+		if err != nil {
+			return httpError(r, err.Error(), http.StatusBadRequest)
+		}
+
+		ctx := context.Background()
+		if v := r.Header.Get("X-Cache-Timeout"); len(v) > 0 {
+			timeout, err := parseTimeout(v)
+			if err != nil {
+				return httpError(r, err.Error(), http.StatusBadRequest)
+			}
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
 		// Build the request.
 		req, err := retryablehttp.NewRequest(http.MethodGet, uri, nil)
 		if err != nil {
@@ -184,21 +464,29 @@ func makeCacheMissHandler(proxy *url.URL) func(r *http.Request, uri string, cach
 			return httpError(r, fmt.Sprint(err), http.StatusInternalServerError)
 		}
 		copyHeaders(req.Header, r.Header)
+		if stale != nil {
+			setConditionalHeaders(req.Header, stale)
+		}
+		// Pass the cacheable status codes to checkRedirect, and the
+		// request's rate to politeTransport, collecting time spent waiting.
+		ctx = context.WithValue(ctx, cacheableKey, cacheable)
+		ctx = context.WithValue(ctx, upstreamWaitKey, wait)
+		ctx = context.WithValue(ctx, requestRateKey, rate)
+		req = req.WithContext(ctx)
 
 		// log.Printf("Outgoing request URL: %s\n", uri)
 		// log.Printf("Outgoing headers: %v\n", req.Header)
 
-		// Get appropriately configured client.
-		client := secureClient
-		if r.Header.Get("X-Cache-SSL") == "INSECURE" {
-			client = insecureClient
-		}
 		// Do the request.
 		rstart := time.Now()
 		response, err := client.Do(req)
 		if err != nil {
+			if response != nil {
+				// (The error handler passes through any last response.)
+				response.Body.Close()
+			}
 			log.Printf("client.Do error: %v\n", err)
-			return httpError(r, fmt.Sprint(err), http.StatusInternalServerError)
+			return upstreamFailed(httpError(r, fmt.Sprint(err), upstreamErrorStatus(err)))
 		}
 		defer response.Body.Close()
 
@@ -206,17 +494,46 @@ func makeCacheMissHandler(proxy *url.URL) func(r *http.Request, uri string, cach
 		rdur := rend.Sub(rstart)
 		responseTime := float64(rdur) / float64(time.Millisecond)
 
+		if stale != nil && response.StatusCode == http.StatusNotModified {
+			// Our stale copy is still valid, keep any updated validators.
+			io.Copy(io.Discard, response.Body)
+			stale.Created = rend.UTC()
+			stale.Imported = time.Time{}
+			if v := response.Header.Get("ETag"); len(v) > 0 {
+				stale.ETag = v
+			}
+			if v := response.Header.Get("Last-Modified"); len(v) > 0 {
+				stale.LastModified = v
+			}
+			err = cache.Refresh(stale)
+			if err != nil {
+				log.Printf("cache.Refresh error: %v\n", err)
+				return httpError(r, fmt.Sprint(err), http.StatusInternalServerError)
+			}
+			resp := cachedResponse(r, stale, "REVALIDATED", o)
+			setChanged(resp, false)
+			return resp
+		}
+
 		// TODO Should we check content type is text/HTML/JSON/CSS (not binary data) ?
 
-		// Read the response body, limiting the max size.
-		lr := io.LimitedReader{R: response.Body, N: maxBodySize + 1}
-		body, err := io.ReadAll(&lr)
-		if err != nil {
-			// TODO(js) This has failed before. Can we retry somehow?
-			log.Printf("ioutil.ReadAll error: %v\n", err)
-			return httpError(r, fmt.Sprint(err), http.StatusInternalServerError)
+		// Check status code is cacheable - by default we only accept 200 ok
+		// (the client handles redirects, unless their status is cacheable).
+		if !cacheable.has(response.StatusCode) {
+			// Upstream error.
+			// TODO We could return the original status code + body? No...
+			io.Copy(io.Discard, response.Body)
+			m := fmt.Sprintf("Upstream server returned status %s - %s", response.Status, http.StatusText(response.StatusCode))
+			log.Println(m)
+			if response.StatusCode >= 500 {
+				return upstreamFailed(httpError(r, m, response.StatusCode))
+			}
+			return httpError(r, m, response.StatusCode)
 		}
-		if lr.N == 0 {
+
+		// Spool the response body to disk, limiting the max size.
+		body, err := spoolBody(response.Body, maxBodySize)
+		if err == errBodyTooLarge {
 			// Exceeded max body size.
 			io.Copy(io.Discard, response.Body)
 			max := byteCountDecimal(maxBodySize)
@@ -224,17 +541,21 @@ func makeCacheMissHandler(proxy *url.URL) func(r *http.Request, uri string, cach
 			log.Println(m)
 			return httpError(r, m, http.StatusInsufficientStorage)
 		}
+		if err != nil {
+			// TODO(js) This has failed before. Can we retry somehow?
+			log.Printf("spoolBody error: %v\n", err)
+			return upstreamFailed(httpError(r, fmt.Sprint(err), upstreamErrorStatus(err)))
+		}
 		log.Printf("upstream request duration %.3fms", float64(time.Since(rstart))/float64(time.Millisecond))
 
-		// Check status code is good - we only accept 200 ok (the client handles redirects).
-		if response.StatusCode != 200 {
-			// Upstream error.
-			// TODO We could return the original status code + body? No...
-			// TODO Should we return a 500 here - we only handle 200.
-			m := fmt.Sprintf("Upstream server returned status %s - %s", response.Status, http.StatusText(response.StatusCode))
-			log.Println(m)
-			return httpError(r, m, response.StatusCode)
-		}
+		// The spool is removed when the client closes the body,
+		// or here, if we don't get that far.
+		sent := false
+		defer func() {
+			if !sent {
+				body.Close()
+			}
+		}()
 
 		// Check page body against reject rules.
 
@@ -254,12 +575,10 @@ func makeCacheMissHandler(proxy *url.URL) func(r *http.Request, uri string, cach
 			return httpError(r, m, http.StatusInternalServerError)
 		}
 
-		for _, re := range rules {
-			// Abort the request if any rule matches.
-			if re.Match(body) {
-				m := fmt.Sprintf("Content rejected by match: %s", re.String())
-				return httpError(r, m, http.StatusPreconditionFailed)
-			}
+		// Abort the request if any rule matches.
+		if re := body.matchAny(rules); re != nil {
+			m := fmt.Sprintf("Content rejected by match: %s", re.String())
+			return httpError(r, m, http.StatusPreconditionFailed)
 		}
 
 		// Get metadata.
@@ -271,28 +590,78 @@ func makeCacheMissHandler(proxy *url.URL) func(r *http.Request, uri string, cach
 		lastMod := response.Header.Get("Last-Modified")
 
 		// Put asset in the cache.
-		cr, err := NewCacheRecord(uri, status, proto, lang, mime, etag, lastMod, body, responseTime, rend)
+		cr, err := newCacheRecord(uri, status, proto, lang, mime, etag, lastMod, responseTime, rend)
+		if err == nil {
+			err = cr.setSpooledBody(body)
+		}
 		if err != nil {
 			log.Printf("Error creating CacheRecord: %v\n", err)
 			return httpError(r, fmt.Sprint(err), http.StatusInternalServerError)
 		}
-		err = cache.Put(cr)
+		if isRedirect(status) {
+			cr.Location = response.Header.Get("Location")
+		}
+		// Find the previous version, to report whether the content changed.
+		prev := stale
+		if prev == nil && o.config.Versions {
+			prev, err = cache.GetPrevious(uri)
+			if err != nil && err != ErrCacheMiss {
+				log.Printf("cache.GetPrevious error: %v\n", err)
+			}
+		}
+		if stale != nil {
+			err = cache.Replace(cr, o.config.Versions)
+		} else {
+			err = cache.Put(cr)
+		}
 		if err != nil {
 			log.Printf("cache.Put error: %v\n", err)
 			return httpError(r, fmt.Sprint(err), http.StatusInternalServerError)
 		}
-		// log.Printf("cached content size %s", byteCountDecimal(int64(len(body))))
+		// log.Printf("cached content size %s", byteCountDecimal(body.size))
 
 		// Finally, send to client.
+		resp := newResponse(r, status)
+		resp.Header.Set("X-Cache", "MISS")
 		applyCommonHeaders(resp, cr)
+		if prev != nil {
+			setChanged(resp, prev.MD5 != cr.MD5)
+		}
+		setExpires(resp, cr, o.recordTTL(cr))
 		switch r.Method {
 		case "GET":
-			resp.Body = io.NopCloser(bytes.NewBuffer(body))
+			resp.Body = body.readCloser()
+			sent = true
 		case "HEAD":
 			// No action.
 		}
 		return resp
 	}
+
+	return func(r *http.Request, uri string, cache Cache, stale *CacheRecord) *http.Response {
+		// Report time spent waiting on upstream limits.
+		wait := &upstreamWait{}
+		resp := fetch(r, uri, cache, stale, wait)
+		resp.Header.Set("X-Cache-Upstream-Wait", wait.get().Round(time.Millisecond).String())
+		return resp
+	}
+}
+
+// setChanged sets the X-Cache-Changed header, reporting whether
+// the content differs from its previous version.
+func setChanged(resp *http.Response, changed bool) {
+	if changed {
+		resp.Header.Set("X-Cache-Changed", "TRUE")
+	} else {
+		resp.Header.Set("X-Cache-Changed", "FALSE")
+	}
+}
+
+// applyHitHeaders sets the headers of a response served from the cache.
+func applyHitHeaders(resp *http.Response, cr *CacheRecord, xcache string, o *options) {
+	resp.Header.Set("X-Cache", xcache)
+	applyCommonHeaders(resp, cr)
+	setExpires(resp, cr, o.recordTTL(cr))
 }
 
 func applyCommonHeaders(resp *http.Response, cr *CacheRecord) {
@@ -300,6 +669,9 @@ func applyCommonHeaders(resp *http.Response, cr *CacheRecord) {
 	// so that old cache dbs (created before today, 11-Aug-2020)
 	// will still present times as UTC.
 	resp.Header.Set("X-Cache-Timestamp", cr.Created.UTC().Format(time.RFC3339Nano))
+	if len(cr.Bin) > 0 {
+		resp.Header.Set("X-Cache-Bin-File", cr.Bin)
+	}
 	resp.Header.Set("Content-Length", strconv.Itoa(int(cr.ContentLength)))
 	if len(cr.ContentType) > 0 {
 		resp.Header.Set("Content-Type", cr.ContentType)
@@ -313,6 +685,22 @@ func applyCommonHeaders(resp *http.Response, cr *CacheRecord) {
 	if len(cr.ContentLanguage) > 0 {
 		resp.Header.Set("Content-Language", cr.ContentLanguage)
 	}
+	if len(cr.Location) > 0 {
+		resp.Header.Set("Location", cr.Location)
+	}
+}
+
+// upstreamErrorStatus returns the status code to report for an upstream error.
+func upstreamErrorStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		// X-Cache-Timeout exceeded.
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+func isRedirect(status int) bool {
+	return status >= 300 && status < 400
 }
 
 func newResponse(r *http.Request /*contentType string,*/, status int) *http.Response {
@@ -368,7 +756,26 @@ var (
 
 var acceptAllCerts = &tls.Config{InsecureSkipVerify: true}
 
-func newClient(insecure bool, proxy *url.URL) *retryablehttp.Client {
+type contextKey int
+
+// cacheableKey is the context key for a request's cacheable statusSet.
+const cacheableKey contextKey = 0
+
+// checkRedirect stops the client from following a redirect
+// if the redirect's status code is cacheable for the request.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	cacheable, ok := req.Context().Value(cacheableKey).(statusSet)
+	if ok && req.Response != nil && cacheable.has(req.Response.StatusCode) {
+		return http.ErrUseLastResponse
+	}
+	// Same as the default policy.
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
+}
+
+func newClient(insecure bool, proxy *url.URL, polite *politeness) *retryablehttp.Client {
 	// TODO Client configuration - see https://medium.com/@nate510/don-t-use-go-s-default-http-client-4804cb19f779
 
 	// TODO Note that because we use a retrying client, this means outgoing HTTP requests can now take a longer time.
@@ -383,9 +790,13 @@ func newClient(insecure bool, proxy *url.URL) *retryablehttp.Client {
 		RetryWaitMax: defaultRetryWaitMax,
 		RetryMax:     defaultRetryMax,
 		CheckRetry:   retryablehttp.DefaultRetryPolicy,
-		Backoff:      retryablehttp.DefaultBackoff,
+		Backoff:      backoff,
+		// Once retries run out, return the last response (e.g. a 503),
+		// so it can be cached or forwarded, rather than an error.
+		ErrorHandler: retryablehttp.PassthroughErrorHandler,
 	}
 	// client.Logger = nil
+	client.HTTPClient.CheckRedirect = checkRedirect
 
 	// tr := &http.Transport{Proxy: http.ProxyURL(u), TLSClientConfig: acceptAllCerts}
 
@@ -396,6 +807,8 @@ func newClient(insecure bool, proxy *url.URL) *retryablehttp.Client {
 	if proxy != nil {
 		tr.Proxy = http.ProxyURL(proxy)
 	}
+	// Apply per base domain limits to all upstream requests (including retries).
+	client.HTTPClient.Transport = &politeTransport{base: tr, p: polite}
 
 	return client
 }
@@ -435,6 +848,10 @@ func shouldCopyHeader(headerKey string) bool {
 		// If we copy it across, and it says gzip (it will do),
 		// then we have to manually handle gzip decoding.
 		return false
+	case "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range", "Range":
+		// The client's conditional and Range requests are answered from the cache,
+		// we always want the whole body from upstream.
+		return false
 	}
 
 	// TODO(js) Perhaps we should have a more precise filter, for our specific X- headers? Arguably, it's more complex and harder to maintain. So let's leave this unless it causes an issue.
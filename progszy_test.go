@@ -1,17 +1,26 @@
 package progszy_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/tls"
+	"fmt"
 	"io"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/jimsmart/progszy"
+	"github.com/valyala/gozstd"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -399,8 +408,1132 @@ var _ = Describe("Progszy", func() {
 
 })
 
+var _ = Describe("Progszy with local upstream", func() {
+
+	var upstream *testUpstream
+	var server *httptest.Server
+	var cache progszy.Cache
+	var client *http.Client
+	var opts []progszy.Option
+
+	BeforeEach(func() {
+		upstream = newTestUpstream()
+		cache = progszy.NewSqliteCache(testCachePath)
+		opts = nil
+	})
+
+	JustBeforeEach(func() {
+		server = httptest.NewServer(progszy.ProxyHandlerWith(cache, nil, opts...))
+		var err error
+		client, err = newProxyClient(server.URL)
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		client.CloseIdleConnections()
+		server.Close()
+		upstream.Close()
+		err := cache.CloseAll()
+		Expect(err).To(BeNil())
+		err = deleteSqliteDBs()
+		Expect(err).To(BeNil())
+	})
+
+	It("should not cache a 404 by default", func() {
+		resp := get(client, upstream.URL+"/missing", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		readBody(resp)
+		resp = get(client, upstream.URL+"/missing", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		readBody(resp)
+		Expect(upstream.count("/missing")).To(Equal(2))
+	})
+
+	It("should cache a 404 when requested", func() {
+		h := http.Header{"X-Cache-Cacheable": {"200,404"}}
+		resp := get(client, upstream.URL+"/missing", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+		Expect(readBody(resp)).To(Equal("not found"))
+
+		resp = get(client, upstream.URL+"/missing", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		Expect(readBody(resp)).To(Equal("not found"))
+		Expect(upstream.count("/missing")).To(Equal(1))
+	})
+
+	It("should cache a redirect when requested", func() {
+		// Don't let our client follow the redirect.
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+
+		h := http.Header{"X-Cache-Cacheable": {"200,3xx"}}
+		resp := get(client, upstream.URL+"/moved", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusMovedPermanently))
+		Expect(resp.Header.Get("Location")).To(Equal("/ok"))
+		readBody(resp)
+
+		resp = get(client, upstream.URL+"/moved", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusMovedPermanently))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		Expect(resp.Header.Get("Location")).To(Equal("/ok"))
+		readBody(resp)
+		Expect(upstream.count("/moved")).To(Equal(1))
+		Expect(upstream.count("/ok")).To(Equal(0))
+	})
+
+	It("should stream large bodies into and out of the cache", func() {
+		resp := get(client, upstream.URL+"/large", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+		body1 := readBody(resp)
+		Expect(body1).To(HaveLen(largeContentSize))
+
+		resp = get(client, upstream.URL+"/large", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		body2 := readBody(resp)
+		Expect(body2).To(Equal(body1))
+		Expect(upstream.count("/large")).To(Equal(1))
+	})
+
+	It("should reject large bodies matching a reject rule", func() {
+		h := http.Header{"X-Cache-Reject": {"no-match", "needle"}}
+		resp := get(client, upstream.URL+"/large", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusPreconditionFailed))
+		readBody(resp)
+
+		resp = get(client, upstream.URL+"/large", nil)
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+		readBody(resp)
+	})
+
+	It("should not contact upstream when offline", func() {
+		h := http.Header{"X-Cache-Mode": {"OFFLINE"}}
+		resp := get(client, upstream.URL+"/ok", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusGatewayTimeout))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS-OFFLINE"))
+		readBody(resp)
+		Expect(upstream.count("/ok")).To(Equal(0))
+
+		resp = get(client, upstream.URL+"/ok", nil)
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+		readBody(resp)
+
+		resp = get(client, upstream.URL+"/ok", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		Expect(readBody(resp)).To(Equal("ok-content"))
+		Expect(upstream.count("/ok")).To(Equal(1))
+	})
+
+	It("should coalesce concurrent misses for the same URL", func() {
+		const n = 5
+		var wg sync.WaitGroup
+		xcache := make([]string, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				resp := get(client, upstream.URL+"/slow?b=2&a=1", nil)
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(readBody(resp)).To(Equal("slow-content"))
+				xcache[i] = resp.Header.Get("X-Cache")
+			}(i)
+		}
+		wg.Wait()
+		Expect(upstream.count("/slow")).To(Equal(1))
+		Expect(xcache).To(ContainElement("MISS"))
+		Expect(xcache).To(ContainElement("COALESCED"))
+	})
+
+	Context("with upstream limits", func() {
+
+		BeforeEach(func() {
+			opts = []progszy.Option{progszy.WithConfig(&progszy.Config{
+				DomainConfig: progszy.DomainConfig{Rate: "10/s"},
+				Domains: map[string]progszy.DomainConfig{
+					"127.0.0.1": {MaxInFlight: 1},
+				},
+			})}
+		})
+
+		It("should rate limit upstream requests", func() {
+			start := time.Now()
+			for i := 0; i < 4; i++ {
+				resp := get(client, upstream.URL+"/ok?n="+strconv.Itoa(i), nil)
+				Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+				readBody(resp)
+			}
+			// The first request is immediate, then 100ms between requests.
+			Expect(time.Since(start)).To(BeNumerically(">=", 300*time.Millisecond))
+
+			// Cache hits are not limited.
+			start = time.Now()
+			for i := 0; i < 4; i++ {
+				resp := get(client, upstream.URL+"/ok?n="+strconv.Itoa(i), nil)
+				Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+				readBody(resp)
+			}
+			Expect(time.Since(start)).To(BeNumerically("<", 250*time.Millisecond))
+		})
+
+		It("should limit concurrent upstream requests", func() {
+			start := time.Now()
+			var wg sync.WaitGroup
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					resp := get(client, upstream.URL+"/slow?n="+strconv.Itoa(i), nil)
+					Expect(readBody(resp)).To(Equal("slow-content"))
+				}(i)
+			}
+			wg.Wait()
+			// Each takes 200ms, one at a time.
+			Expect(time.Since(start)).To(BeNumerically(">=", 600*time.Millisecond))
+		})
+
+		It("should apply the X-Cache-Rate limit to its request only", func() {
+			h := http.Header{"X-Cache-Rate": {"2/s"}}
+			start := time.Now()
+			for i := 0; i < 3; i++ {
+				resp := get(client, upstream.URL+"/ok?n="+strconv.Itoa(i), h)
+				readBody(resp)
+			}
+			Expect(time.Since(start)).To(BeNumerically(">=", 900*time.Millisecond))
+
+			// Other requests only get the configured limit, 100ms apart
+			// (at 2/s they would take over a second).
+			start = time.Now()
+			for i := 3; i < 6; i++ {
+				resp := get(client, upstream.URL+"/ok?n="+strconv.Itoa(i), nil)
+				readBody(resp)
+			}
+			Expect(time.Since(start)).To(BeNumerically("<", 800*time.Millisecond))
+		})
+
+		It("should reject an invalid X-Cache-Rate value", func() {
+			h := http.Header{"X-Cache-Rate": {"fast"}}
+			resp := get(client, upstream.URL+"/ok", h)
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			readBody(resp)
+			Expect(upstream.count("/ok")).To(Equal(0))
+		})
+
+	})
+
+	It("should honour Retry-After, pausing all requests to the host", func() {
+		start := time.Now()
+		resp := get(client, upstream.URL+"/busy", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(readBody(resp)).To(Equal("not-busy"))
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+		Expect(upstream.count("/busy")).To(Equal(2))
+		wait, err := time.ParseDuration(resp.Header.Get("X-Cache-Upstream-Wait"))
+		Expect(err).To(BeNil())
+		Expect(wait).To(BeNumerically(">=", 900*time.Millisecond))
+
+		// No longer paused.
+		resp = get(client, upstream.URL+"/ok", nil)
+		Expect(resp.Header.Get("X-Cache-Upstream-Wait")).To(Equal("0s"))
+		readBody(resp)
+	})
+
+	Context("with a max backoff", func() {
+
+		BeforeEach(func() {
+			opts = []progszy.Option{progszy.WithConfig(&progszy.Config{
+				DomainConfig: progszy.DomainConfig{MaxBackoff: "1s"},
+			})}
+		})
+
+		It("should limit the pause given by Retry-After", func() {
+			start := time.Now()
+			resp := get(client, upstream.URL+"/overloaded", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal("not-overloaded"))
+			Expect(time.Since(start)).To(BeNumerically(">=", 900*time.Millisecond))
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+			Expect(upstream.count("/overloaded")).To(Equal(2))
+		})
+
+	})
+
+	It("should only retry the statuses given by X-Cache-Retry-On", func() {
+		h := http.Header{"X-Cache-Retry-On": {"500,502"}}
+		resp := get(client, upstream.URL+"/busy", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+		readBody(resp)
+		Expect(upstream.count("/busy")).To(Equal(1))
+	})
+
+	It("should give up after X-Cache-Retry-Max retries", func() {
+		h := http.Header{"X-Cache-Retry-Max": {"0"}}
+		resp := get(client, upstream.URL+"/busy", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+		readBody(resp)
+		Expect(upstream.count("/busy")).To(Equal(1))
+	})
+
+	It("should cache a 500 when requested, once retries run out", func() {
+		h := http.Header{"X-Cache-Cacheable": {"200,500"}, "X-Cache-Retry-Max": {"1"}}
+		resp := get(client, upstream.URL+"/broken", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+		Expect(readBody(resp)).To(Equal("broken"))
+		Expect(upstream.count("/broken")).To(Equal(2))
+
+		resp = get(client, upstream.URL+"/broken", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		Expect(readBody(resp)).To(Equal("broken"))
+		Expect(upstream.count("/broken")).To(Equal(2))
+	})
+
+	It("should time out upstream requests after X-Cache-Timeout", func() {
+		h := http.Header{"X-Cache-Timeout": {"50ms"}}
+		resp := get(client, upstream.URL+"/slow", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusGatewayTimeout))
+		readBody(resp)
+
+		h = http.Header{"X-Cache-Timeout": {"5"}}
+		resp = get(client, upstream.URL+"/slow", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		readBody(resp)
+	})
+
+	It("should reject invalid retry and timeout values", func() {
+		for _, h := range []http.Header{
+			{"X-Cache-Retry-Max": {"-1"}},
+			{"X-Cache-Retry-On": {"often"}},
+			{"X-Cache-Timeout": {"soon"}},
+			{"X-Cache-Timeout": {"0s"}},
+		} {
+			resp := get(client, upstream.URL+"/ok", h)
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			readBody(resp)
+		}
+		Expect(upstream.count("/ok")).To(Equal(0))
+	})
+
+	It("should revalidate a stale hit using its ETag", func() {
+		resp := get(client, upstream.URL+"/etag", nil)
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+		readBody(resp)
+		ts := resp.Header.Get("X-Cache-Timestamp")
+
+		h := http.Header{"X-Cache-Max-Age": {"1h"}}
+		resp = get(client, upstream.URL+"/etag", h)
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		readBody(resp)
+		Expect(upstream.count("/etag")).To(Equal(1))
+
+		h = http.Header{"X-Cache-Max-Age": {"0"}}
+		resp = get(client, upstream.URL+"/etag", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("REVALIDATED"))
+		Expect(resp.Header.Get("X-Cache-Timestamp")).ToNot(Equal(ts))
+		Expect(readBody(resp)).To(Equal("etag-content"))
+		Expect(upstream.count("/etag")).To(Equal(2))
+
+		resp = get(client, upstream.URL+"/etag", nil)
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		Expect(readBody(resp)).To(Equal("etag-content"))
+	})
+
+	It("should keep updated validators from a revalidation", func() {
+		resp := get(client, upstream.URL+"/revalidated", nil)
+		Expect(resp.Header.Get("Last-Modified")).To(Equal("Mon, 02 Jan 2006 15:04:05 GMT"))
+		readBody(resp)
+
+		h := http.Header{"X-Cache-Max-Age": {"0"}}
+		resp = get(client, upstream.URL+"/revalidated", h)
+		Expect(resp.Header.Get("X-Cache")).To(Equal("REVALIDATED"))
+		Expect(resp.Header.Get("Last-Modified")).To(Equal("Tue, 03 Jan 2006 15:04:05 GMT"))
+		readBody(resp)
+
+		resp = get(client, upstream.URL+"/revalidated", nil)
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		Expect(resp.Header.Get("ETag")).To(Equal(`"r1"`))
+		Expect(resp.Header.Get("Last-Modified")).To(Equal("Tue, 03 Jan 2006 15:04:05 GMT"))
+		Expect(readBody(resp)).To(Equal("revalidated-content"))
+		Expect(upstream.count("/revalidated")).To(Equal(2))
+	})
+
+	It("should coalesce concurrent revalidations, even with a zero max age", func() {
+		resp := get(client, upstream.URL+"/slow", nil)
+		readBody(resp)
+
+		const n = 5
+		var wg sync.WaitGroup
+		xcache := make([]string, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				h := http.Header{"X-Cache-Max-Age": {"0"}}
+				resp := get(client, upstream.URL+"/slow", h)
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(readBody(resp)).To(Equal("slow-content"))
+				xcache[i] = resp.Header.Get("X-Cache")
+			}(i)
+		}
+		wg.Wait()
+		Expect(upstream.count("/slow")).To(Equal(2))
+		Expect(xcache).To(ContainElement("COALESCED"))
+	})
+
+	It("should replace a stale hit that has changed", func() {
+		resp := get(client, upstream.URL+"/changing", nil)
+		Expect(readBody(resp)).To(Equal("version-1"))
+
+		h := http.Header{"X-Cache-Max-Age": {"0"}}
+		resp = get(client, upstream.URL+"/changing", h)
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+		Expect(readBody(resp)).To(Equal("version-2"))
+
+		resp = get(client, upstream.URL+"/changing", nil)
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		Expect(readBody(resp)).To(Equal("version-2"))
+	})
+
+	It("should not revalidate when offline", func() {
+		resp := get(client, upstream.URL+"/etag", nil)
+		readBody(resp)
+
+		h := http.Header{"X-Cache-Max-Age": {"0"}, "X-Cache-Mode": {"OFFLINE"}}
+		resp = get(client, upstream.URL+"/etag", h)
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		readBody(resp)
+		Expect(upstream.count("/etag")).To(Equal(1))
+	})
+
+	It("should reject an invalid X-Cache-Max-Age value", func() {
+		h := http.Header{"X-Cache-Max-Age": {"-1s"}}
+		resp := get(client, upstream.URL+"/ok", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		readBody(resp)
+		Expect(upstream.count("/ok")).To(Equal(0))
+	})
+
+	Context("with a default max age", func() {
+
+		BeforeEach(func() {
+			opts = append(opts, progszy.WithMaxAge(0))
+		})
+
+		It("should revalidate every hit", func() {
+			resp := get(client, upstream.URL+"/etag", nil)
+			readBody(resp)
+			resp = get(client, upstream.URL+"/etag", nil)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("REVALIDATED"))
+			readBody(resp)
+			Expect(upstream.count("/etag")).To(Equal(2))
+		})
+	})
+
+	It("should answer a client conditional request from the cache", func() {
+		// The client's conditional headers are not passed upstream.
+		h := http.Header{"If-None-Match": {`"v1"`}}
+		resp := get(client, upstream.URL+"/etag", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+		Expect(readBody(resp)).To(Equal("etag-content"))
+
+		resp = get(client, upstream.URL+"/etag", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusNotModified))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		Expect(resp.Header.Get("ETag")).To(Equal(`"v1"`))
+		Expect(readBody(resp)).To(Equal(""))
+
+		h = http.Header{"If-None-Match": {`"v0", W/"v1"`}}
+		resp = get(client, upstream.URL+"/etag", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusNotModified))
+		readBody(resp)
+
+		h = http.Header{"If-None-Match": {`"v0"`}}
+		resp = get(client, upstream.URL+"/etag", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(readBody(resp)).To(Equal("etag-content"))
+		Expect(upstream.count("/etag")).To(Equal(1))
+
+		resp = get(client, upstream.URL+"/changing", nil)
+		readBody(resp)
+		h = http.Header{"If-Modified-Since": {"Mon, 02 Jan 2006 15:04:05 GMT"}}
+		resp = get(client, upstream.URL+"/changing", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusNotModified))
+		readBody(resp)
+		h = http.Header{"If-Modified-Since": {"Sun, 01 Jan 2006 15:04:05 GMT"}}
+		resp = get(client, upstream.URL+"/changing", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(readBody(resp)).To(Equal("version-1"))
+	})
+
+	It("should answer a Range request from the cache", func() {
+		resp := get(client, upstream.URL+"/large", nil)
+		full, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		resp.Body.Close()
+
+		h := http.Header{"Range": {"bytes=1048570-1048579"}}
+		resp = get(client, upstream.URL+"/large", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusPartialContent))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		Expect(resp.Header.Get("Content-Range")).To(Equal(fmt.Sprintf("bytes 1048570-1048579/%d", largeContentSize)))
+		b, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		resp.Body.Close()
+		Expect(b).To(Equal(full[1048570:1048580]))
+
+		h = http.Header{"Range": {"bytes=-6"}}
+		resp = get(client, upstream.URL+"/large", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusPartialContent))
+		Expect(readBody(resp)).To(Equal("needle"))
+
+		h = http.Header{"Range": {"bytes=99999999-"}}
+		resp = get(client, upstream.URL+"/large", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusRequestedRangeNotSatisfiable))
+		Expect(resp.Header.Get("Content-Range")).To(Equal(fmt.Sprintf("bytes */%d", largeContentSize)))
+		readBody(resp)
+
+		h = http.Header{"Range": {"bytes=0-9"}, "If-Range": {`"other"`}}
+		resp = get(client, upstream.URL+"/large", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		resp.Body.Close()
+		Expect(upstream.count("/large")).To(Equal(1))
+	})
+
+	It("should answer a multi-range request from the cache", func() {
+		resp := get(client, upstream.URL+"/ok", nil)
+		readBody(resp)
+
+		h := http.Header{"Range": {"bytes=0-1,-7"}}
+		resp = get(client, upstream.URL+"/ok", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusPartialContent))
+		mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		Expect(err).To(BeNil())
+		Expect(mediaType).To(Equal("multipart/byteranges"))
+		b, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		resp.Body.Close()
+		Expect(resp.Header.Get("Content-Length")).To(Equal(strconv.Itoa(len(b))))
+
+		mr := multipart.NewReader(bytes.NewReader(b), params["boundary"])
+		var parts []string
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			Expect(err).To(BeNil())
+			Expect(p.Header.Get("Content-Type")).To(Equal("text/plain"))
+			pb, err := io.ReadAll(p)
+			Expect(err).To(BeNil())
+			parts = append(parts, p.Header.Get("Content-Range")+" "+string(pb))
+		}
+		Expect(parts).To(Equal([]string{"bytes 0-1/10 ok", "bytes 3-9/10 content"}))
+	})
+
+	It("should pass a cached Zstd body through to the client", func() {
+		resp := get(client, upstream.URL+"/large", nil)
+		full, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		resp.Body.Close()
+
+		h := http.Header{"Accept-Encoding": {"gzip, zstd"}}
+		resp = get(client, upstream.URL+"/large", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		Expect(resp.Header.Get("Content-Encoding")).To(Equal("zstd"))
+		zr := gozstd.NewReader(resp.Body)
+		b, err := io.ReadAll(zr)
+		zr.Release()
+		resp.Body.Close()
+		Expect(err).To(BeNil())
+		Expect(b).To(Equal(full))
+
+		// Not by default, nor when refused.
+		for _, ae := range []string{"gzip", "zstd;q=0"} {
+			h = http.Header{"Accept-Encoding": {ae}}
+			resp = get(client, upstream.URL+"/ok", h)
+			Expect(resp.Header.Get("Content-Encoding")).To(Equal(""))
+			Expect(readBody(resp)).To(Equal("ok-content"))
+		}
+	})
+
+	It("should weaken the ETag of an encoded body", func() {
+		resp := get(client, upstream.URL+"/etag", nil)
+		readBody(resp)
+
+		resp = get(client, upstream.URL+"/etag", http.Header{"Accept-Encoding": {"zstd"}})
+		Expect(resp.Header.Get("Content-Encoding")).To(Equal("zstd"))
+		Expect(resp.Header.Get("ETag")).To(Equal(`W/"v1"`))
+		resp.Body.Close()
+
+		resp = get(client, upstream.URL+"/etag", nil)
+		Expect(resp.Header.Get("ETag")).To(Equal(`"v1"`))
+		readBody(resp)
+	})
+
+	It("should only pass Zstd bodies through that clients can decode", func() {
+		// Bodies get compressed with a window small enough for browsers.
+		content := bytes.Repeat([]byte("large-content "), 700000)
+		cr, err := progszy.NewCacheRecord(upstream.URL+"/large-window", 200, "HTTP/1.1", "", "text/plain", "", "", content, 0, time.Now())
+		Expect(err).To(BeNil())
+		err = cache.Put(cr)
+		Expect(err).To(BeNil())
+		h := http.Header{"Accept-Encoding": {"zstd"}}
+		resp := get(client, upstream.URL+"/large-window", h)
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		Expect(resp.Header.Get("Content-Encoding")).To(Equal("zstd"))
+		resp.Body.Close()
+
+		// But those stored with a larger window (e.g. by earlier versions) are decoded.
+		var buf bytes.Buffer
+		zw := gozstd.NewWriterParams(&buf, &gozstd.WriterParams{CompressionLevel: 3, WindowLog: 24})
+		_, err = zw.Write([]byte("legacy-content"))
+		Expect(err).To(BeNil())
+		Expect(zw.Close()).To(BeNil())
+		zw.Release()
+		cr, err = progszy.NewCacheRecord(upstream.URL+"/legacy", 200, "HTTP/1.1", "", "text/plain", "", "", nil, 0, time.Now())
+		Expect(err).To(BeNil())
+		cr.ZstdBody = buf.Bytes()
+		cr.CompressedLength = int64(buf.Len())
+		cr.ContentLength = int64(len("legacy-content"))
+		err = cache.Put(cr)
+		Expect(err).To(BeNil())
+		resp = get(client, upstream.URL+"/legacy", h)
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		Expect(resp.Header.Get("Content-Encoding")).To(Equal(""))
+		Expect(readBody(resp)).To(Equal("legacy-content"))
+		Expect(upstream.count("/legacy")).To(Equal(0))
+	})
+
+	Context("with gzip enabled", func() {
+
+		BeforeEach(func() {
+			opts = append(opts, progszy.WithGzip(true))
+		})
+
+		It("should transcode a cached body to gzip", func() {
+			resp := get(client, upstream.URL+"/ok", nil)
+			readBody(resp)
+
+			h := http.Header{"Accept-Encoding": {"gzip"}}
+			resp = get(client, upstream.URL+"/ok", h)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+			Expect(resp.Header.Get("Content-Encoding")).To(Equal("gzip"))
+			zr, err := gzip.NewReader(resp.Body)
+			Expect(err).To(BeNil())
+			b, err := io.ReadAll(zr)
+			resp.Body.Close()
+			Expect(err).To(BeNil())
+			Expect(string(b)).To(Equal("ok-content"))
+		})
+	})
+
+	Context("with cached pages", func() {
+
+		JustBeforeEach(func() {
+			for _, path := range []string{"/ok", "/etag", "/changing"} {
+				resp := get(client, upstream.URL+path, nil)
+				Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+				readBody(resp)
+			}
+		})
+
+		expectCached := func(path string, cached bool) {
+			resp := get(client, upstream.URL+path, http.Header{"X-Cache-Mode": {"OFFLINE"}})
+			readBody(resp)
+			if cached {
+				Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+			} else {
+				Expect(resp.Header.Get("X-Cache")).To(Equal("MISS-OFFLINE"))
+			}
+		}
+
+		It("should evict a single URL", func() {
+			h := http.Header{"X-Cache-Evict": {"TRUE"}}
+			resp := get(client, upstream.URL+"/ok", h)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("X-Cache")).To(Equal("EVICTED"))
+			Expect(resp.Header.Get("X-Cache-Evicted")).To(Equal("1"))
+			readBody(resp)
+			expectCached("/ok", false)
+			expectCached("/etag", true)
+			expectCached("/changing", true)
+
+			resp = get(client, upstream.URL+"/ok", h)
+			Expect(resp.Header.Get("X-Cache-Evicted")).To(Equal("0"))
+			readBody(resp)
+			Expect(upstream.count("/ok")).To(Equal(1))
+		})
+
+		It("should evict URLs by prefix", func() {
+			h := http.Header{"X-Cache-Evict": {"PREFIX"}}
+			resp := get(client, upstream.URL+"/", h)
+			Expect(resp.Header.Get("X-Cache-Evicted")).To(Equal("3"))
+			readBody(resp)
+			expectCached("/ok", false)
+			expectCached("/etag", false)
+			expectCached("/changing", false)
+		})
+
+		It("should evict URLs by regex", func() {
+			h := http.Header{"X-Cache-Evict": {"REGEX"}, "X-Cache-Evict-Pattern": {"/(ok|etag)$"}}
+			resp := get(client, upstream.URL+"/", h)
+			Expect(resp.Header.Get("X-Cache-Evicted")).To(Equal("2"))
+			readBody(resp)
+			expectCached("/ok", false)
+			expectCached("/etag", false)
+			expectCached("/changing", true)
+		})
+
+		It("should reject invalid eviction values", func() {
+			for _, h := range []http.Header{
+				{"X-Cache-Evict": {"ALL"}},
+				{"X-Cache-Evict": {"REGEX"}, "X-Cache-Evict-Pattern": {"(ok"}},
+			} {
+				resp := get(client, upstream.URL+"/ok", h)
+				Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+				readBody(resp)
+			}
+			expectCached("/ok", true)
+		})
+	})
+
+	Context("with a TTL", func() {
+
+		BeforeEach(func() {
+			config := &progszy.Config{}
+			config.TTL = "1h"
+			config.Domains = map[string]progszy.DomainConfig{
+				"127.0.0.1": {TTL: "200ms"},
+			}
+			opts = append(opts, progszy.WithConfig(config))
+		})
+
+		It("should report when a hit expires", func() {
+			resp := get(client, upstream.URL+"/ok", nil)
+			readBody(resp)
+			ts, err := time.Parse(time.RFC3339Nano, resp.Header.Get("X-Cache-Timestamp"))
+			Expect(err).To(BeNil())
+			exp, err := time.Parse(time.RFC3339Nano, resp.Header.Get("X-Cache-Expires"))
+			Expect(err).To(BeNil())
+			Expect(exp.Sub(ts)).To(Equal(200 * time.Millisecond))
+
+			resp = get(client, upstream.URL+"/ok", nil)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+			Expect(resp.Header.Get("X-Cache-Expires")).To(Equal(exp.Format(time.RFC3339Nano)))
+			readBody(resp)
+		})
+
+		It("should not serve an expired hit", func() {
+			resp := get(client, upstream.URL+"/ok", nil)
+			readBody(resp)
+			time.Sleep(300 * time.Millisecond)
+
+			h := http.Header{"X-Cache-Mode": {"OFFLINE"}}
+			resp = get(client, upstream.URL+"/ok", h)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("MISS-OFFLINE"))
+			readBody(resp)
+
+			resp = get(client, upstream.URL+"/ok", nil)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+			readBody(resp)
+			Expect(upstream.count("/ok")).To(Equal(2))
+
+			resp = get(client, upstream.URL+"/ok", nil)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+			readBody(resp)
+		})
+
+		Context("binned by rules", func() {
+
+			BeforeEach(func() {
+				err := cache.CloseAll()
+				Expect(err).To(BeNil())
+				binner, err := progszy.NewRegexBinner([]progszy.BinRule{{Match: "/ok$", Bin: "pages"}}, nil)
+				Expect(err).To(BeNil())
+				cache = progszy.NewSqliteCacheWithBinner(testCachePath, binner)
+				config := &progszy.Config{}
+				config.Domains = map[string]progszy.DomainConfig{
+					"127.0.0.1": {TTL: "200ms"},
+					"pages":     {TTL: "1h"},
+				}
+				opts = append(opts, progszy.WithConfig(config))
+			})
+
+			It("should use the TTL of the bin's key, like the sweeper", func() {
+				resp := get(client, upstream.URL+"/ok", nil)
+				readBody(resp)
+				ts, err := time.Parse(time.RFC3339Nano, resp.Header.Get("X-Cache-Timestamp"))
+				Expect(err).To(BeNil())
+				exp, err := time.Parse(time.RFC3339Nano, resp.Header.Get("X-Cache-Expires"))
+				Expect(err).To(BeNil())
+				Expect(exp.Sub(ts)).To(Equal(time.Hour))
+				time.Sleep(300 * time.Millisecond)
+
+				resp = get(client, upstream.URL+"/ok", nil)
+				Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+				Expect(resp.Header.Get("X-Cache-Expires")).To(Equal(exp.Format(time.RFC3339Nano)))
+				readBody(resp)
+			})
+		})
+	})
+
+	Context("with namespaces", func() {
+
+		AfterEach(func() {
+			for _, ns := range []string{"alpha", "beta"} {
+				err := os.RemoveAll(filepath.Join(testCachePath, ns))
+				Expect(err).To(BeNil())
+			}
+		})
+
+		It("should keep each namespace's cache apart", func() {
+			alpha := http.Header{"X-Cache-Namespace": {"alpha"}}
+			beta := http.Header{"X-Cache-Namespace": {"beta"}}
+
+			resp := get(client, upstream.URL+"/ok", alpha)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+			readBody(resp)
+			resp = get(client, upstream.URL+"/ok", alpha)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+			readBody(resp)
+			resp = get(client, upstream.URL+"/ok", beta)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+			readBody(resp)
+			resp = get(client, upstream.URL+"/ok", nil)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+			readBody(resp)
+			Expect(upstream.count("/ok")).To(Equal(3))
+
+			names, err := cache.Namespaces()
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{"alpha", "beta"}))
+			bins, err := cache.Bins()
+			Expect(err).To(BeNil())
+			Expect(bins).To(HaveLen(1))
+
+			// Flushing one namespace leaves the others alone.
+			h := http.Header{"X-Cache-Namespace": {"alpha"}, "X-Cache-Flush": {"TRUE"}}
+			resp = get(client, upstream.URL+"/ok", h)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("FLUSHED"))
+			readBody(resp)
+			resp = get(client, upstream.URL+"/ok", beta)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+			readBody(resp)
+		})
+
+		It("should reject an invalid X-Cache-Namespace value", func() {
+			for _, ns := range []string{"..", "../alpha", "a/b", ".hidden"} {
+				h := http.Header{"X-Cache-Namespace": {ns}}
+				resp := get(client, upstream.URL+"/ok", h)
+				Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+				readBody(resp)
+			}
+			Expect(upstream.count("/ok")).To(Equal(0))
+		})
+	})
+
+	It("should serve a hit as of a given time", func() {
+		resp := get(client, upstream.URL+"/ok", nil)
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+		bin := resp.Header.Get("X-Cache-Bin-File")
+		Expect(bin).To(HavePrefix("127.0.0.1-"))
+		readBody(resp)
+
+		h := http.Header{"X-Cache-As-Of": {time.Now().Add(time.Minute).Format(time.RFC3339)}}
+		resp = get(client, upstream.URL+"/ok", h)
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		Expect(resp.Header.Get("X-Cache-Bin-File")).To(Equal(bin))
+		readBody(resp)
+
+		h = http.Header{"X-Cache-As-Of": {"2020-01-01T00:00:00Z"}}
+		resp = get(client, upstream.URL+"/ok", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusGatewayTimeout))
+		readBody(resp)
+
+		h = http.Header{"X-Cache-As-Of": {"last month"}}
+		resp = get(client, upstream.URL+"/ok", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		readBody(resp)
+		Expect(upstream.count("/ok")).To(Equal(1))
+	})
+
+	Context("with versions", func() {
+
+		BeforeEach(func() {
+			opts = append(opts, progszy.WithConfig(&progszy.Config{Versions: true}))
+		})
+
+		It("should keep refetched versions, and report changes", func() {
+			resp := get(client, upstream.URL+"/changing", nil)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+			Expect(resp.Header.Get("X-Cache-Changed")).To(BeEmpty())
+			readBody(resp)
+
+			h := http.Header{"X-Cache-Max-Age": {"0"}}
+			resp = get(client, upstream.URL+"/changing", h)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+			Expect(resp.Header.Get("X-Cache-Changed")).To(Equal("TRUE"))
+			Expect(readBody(resp)).To(Equal("version-2"))
+
+			versions, err := cache.Versions(upstream.URL + "/changing")
+			Expect(err).To(BeNil())
+			Expect(versions).To(HaveLen(2))
+			Expect(versions[0].Created.After(versions[1].Created)).To(BeTrue())
+
+			resp = get(client, upstream.URL+"/ok", nil)
+			readBody(resp)
+			resp = get(client, upstream.URL+"/ok", h)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+			Expect(resp.Header.Get("X-Cache-Changed")).To(Equal("FALSE"))
+			readBody(resp)
+
+			resp = get(client, upstream.URL+"/etag", nil)
+			readBody(resp)
+			resp = get(client, upstream.URL+"/etag", h)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("REVALIDATED"))
+			Expect(resp.Header.Get("X-Cache-Changed")).To(Equal("FALSE"))
+			readBody(resp)
+		})
+	})
+
+	Context("with older bins", func() {
+
+		const oldBin = "127.0.0.1-2020-01-01-0000.sqlite"
+
+		// retire makes the current bin old, and starts a new one.
+		retire := func() {
+			err := cache.CloseAll()
+			Expect(err).To(BeNil())
+			matches, err := filepath.Glob(filepath.Join(testCachePath, "127.0.0.1-*.sqlite"))
+			Expect(err).To(BeNil())
+			Expect(matches).To(HaveLen(1))
+			err = os.Rename(matches[0], filepath.Join(testCachePath, oldBin))
+			Expect(err).To(BeNil())
+			err = cache.Rotate("127.0.0.1")
+			Expect(err).To(BeNil())
+		}
+
+		It("should serve a stale copy when upstream fails", func() {
+			resp := get(client, upstream.URL+"/flaky", nil)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+			readBody(resp)
+			retire()
+
+			h := http.Header{"X-Cache-Retry-Max": {"0"}}
+			resp = get(client, upstream.URL+"/flaky", h)
+			Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+			readBody(resp)
+
+			h.Set("X-Cache-Stale-If-Error", "TRUE")
+			resp = get(client, upstream.URL+"/flaky", h)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("X-Cache")).To(Equal("STALE"))
+			Expect(resp.Header.Get("X-Cache-Bin-File")).To(Equal(oldBin))
+			Expect(readBody(resp)).To(Equal("flaky-content"))
+			Expect(upstream.count("/flaky")).To(Equal(3))
+
+			h.Set("X-Cache-Stale-If-Error", "MAYBE")
+			resp = get(client, upstream.URL+"/flaky", h)
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			readBody(resp)
+		})
+
+		It("should copy a miss forward from an older bin", func() {
+			resp := get(client, upstream.URL+"/ok", nil)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+			readBody(resp)
+			retire()
+
+			h := http.Header{"X-Cache-Fallback": {"COPY"}}
+			resp = get(client, upstream.URL+"/ok", h)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("FALLBACK"))
+			Expect(resp.Header.Get("X-Cache-Bin-File")).ToNot(Equal(oldBin))
+			Expect(readBody(resp)).To(Equal("ok-content"))
+
+			resp = get(client, upstream.URL+"/ok", nil)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+			readBody(resp)
+			Expect(upstream.count("/ok")).To(Equal(1))
+
+			h = http.Header{"X-Cache-Fallback": {"SIDEWAYS"}}
+			resp = get(client, upstream.URL+"/ok", h)
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			readBody(resp)
+		})
+
+		It("should refetch a miss, falling back to an older bin", func() {
+			resp := get(client, upstream.URL+"/flaky", nil)
+			readBody(resp)
+			resp = get(client, upstream.URL+"/ok", nil)
+			readBody(resp)
+			retire()
+
+			h := http.Header{"X-Cache-Fallback": {"REFETCH"}, "X-Cache-Retry-Max": {"0"}}
+			resp = get(client, upstream.URL+"/ok", h)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+			readBody(resp)
+			resp = get(client, upstream.URL+"/flaky", h)
+			Expect(resp.Header.Get("X-Cache")).To(Equal("STALE"))
+			Expect(readBody(resp)).To(Equal("flaky-content"))
+			Expect(upstream.count("/ok")).To(Equal(2))
+			Expect(upstream.count("/flaky")).To(Equal(2))
+		})
+	})
+
+	It("should reject an invalid X-Cache-Mode value", func() {
+		h := http.Header{"X-Cache-Mode": {"SIDEWAYS"}}
+		resp := get(client, upstream.URL+"/ok", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		readBody(resp)
+		Expect(upstream.count("/ok")).To(Equal(0))
+	})
+
+	It("should reject an invalid X-Cache-Cacheable value", func() {
+		h := http.Header{"X-Cache-Cacheable": {"200,abc"}}
+		resp := get(client, upstream.URL+"/ok", h)
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		readBody(resp)
+		Expect(upstream.count("/ok")).To(Equal(0))
+	})
+
+})
+
 var acceptAllCerts = &tls.Config{InsecureSkipVerify: true}
 
+const largeContentSize = 3 * 1024 * 1024
+
+// testUpstream is a local HTTP server, counting requests per path.
+type testUpstream struct {
+	*httptest.Server
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newTestUpstream() *testUpstream {
+	u := &testUpstream{counts: make(map[string]int)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "ok-content")
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		// Random content, with a needle at the end.
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(randomContent(largeContentSize - len("needle")))
+		io.WriteString(w, "needle")
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "slow-content")
+	})
+	mux.HandleFunc("/busy", func(w http.ResponseWriter, r *http.Request) {
+		// Too many requests, first time only.
+		if u.count("/busy") == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "busy", http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, "not-busy")
+	})
+	mux.HandleFunc("/overloaded", func(w http.ResponseWriter, r *http.Request) {
+		// Overloaded, for years, first time only.
+		if u.count("/overloaded") == 1 {
+			w.Header().Set("Retry-After", "999999999")
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "not-overloaded")
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+	mux.HandleFunc("/etag", func(w http.ResponseWriter, r *http.Request) {
+		// Supports conditional requests.
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "etag-content")
+	})
+	mux.HandleFunc("/revalidated", func(w http.ResponseWriter, r *http.Request) {
+		// Confirms conditional requests, with a new Last-Modified.
+		w.Header().Set("ETag", `"r1"`)
+		if r.Header.Get("If-None-Match") == `"r1"` {
+			w.Header().Set("Last-Modified", "Tue, 03 Jan 2006 15:04:05 GMT")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "revalidated-content")
+	})
+	mux.HandleFunc("/changing", func(w http.ResponseWriter, r *http.Request) {
+		// Ignores conditional requests, content changes every time.
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "version-%d", u.count("/changing"))
+	})
+	mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		// Fails after the first time.
+		if u.count("/flaky") > 1 {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, "flaky-content")
+	})
+	mux.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok", http.StatusMovedPermanently)
+	})
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		u.counts[r.URL.Path]++
+		u.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	return u
+}
+
+func (u *testUpstream) count(path string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.counts[path]
+}
+
+func get(c *http.Client, uri string, h http.Header) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	Expect(err).To(BeNil())
+	for k, vv := range h {
+		req.Header[k] = vv
+	}
+	resp, err := c.Do(req)
+	Expect(err).To(BeNil())
+	return resp
+}
+
+func readBody(resp *http.Response) string {
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	Expect(err).To(BeNil())
+	return strings.TrimSpace(string(b))
+}
+
 // var noProxyClient = &http.Client{Transport: &http.Transport{TLSClientConfig: acceptAllCerts}}
 
 func newProxyClient(proxyURL string) (*http.Client, error) {
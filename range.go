@@ -0,0 +1,272 @@
+package progszy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Conditional_requests
+// and https://developer.mozilla.org/en-US/docs/Web/HTTP/Range_requests
+
+// TODO(js) Range requests are only answered for cache hits. A miss streams the
+// whole body to the client, as it is being spooled.
+
+// notModified reports whether the client's conditional request headers
+// (If-None-Match, or else If-Modified-Since) match the given record.
+func notModified(r *http.Request, cr *CacheRecord) bool {
+	if inm := r.Header.Get("If-None-Match"); len(inm) > 0 {
+		return len(cr.ETag) > 0 && etagListMatch(inm, cr.ETag)
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if len(ims) == 0 || len(cr.LastModified) == 0 {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(cr.LastModified)
+	if err != nil {
+		return false
+	}
+	return !lm.Truncate(time.Second).After(t)
+}
+
+// etagListMatch reports whether the given If-None-Match list
+// matches etag, using weak comparison.
+func etagListMatch(list, etag string) bool {
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeApplies reports whether the client's If-Range header, if any,
+// matches the given record, so that a Range request can be answered.
+func rangeApplies(r *http.Request, cr *CacheRecord) bool {
+	ir := r.Header.Get("If-Range")
+	if len(ir) == 0 {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) {
+		// Strong comparison.
+		return ir == cr.ETag
+	}
+	return ir == cr.LastModified
+}
+
+// rangeResponse returns a 206 Partial Content response for the given Range
+// header value, or a 416 Range Not Satisfiable. It returns nil if the whole
+// body should be sent instead.
+func rangeResponse(r *http.Request, cr *CacheRecord, rangeHeader, xcache string, o *options) *http.Response {
+	size := cr.ContentLength
+	ranges, err := parseRange(rangeHeader, size)
+	if err != nil {
+		resp := httpError(r, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		resp.Header.Set("X-Cache", xcache)
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return resp
+	}
+	var sum int64
+	for _, hr := range ranges {
+		sum += hr.length
+	}
+	if len(ranges) == 0 || sum > size {
+		// Send the whole body, it is cheaper.
+		return nil
+	}
+
+	resp := newResponse(r, http.StatusPartialContent)
+	applyHitHeaders(resp, cr, xcache, o)
+	resp.Header.Set("Accept-Ranges", "bytes")
+
+	if len(ranges) == 1 {
+		hr := ranges[0]
+		resp.Header.Set("Content-Range", hr.contentRange(size))
+		resp.Header.Set("Content-Length", strconv.FormatInt(hr.length, 10))
+		if r.Method == http.MethodGet {
+			resp.Body, err = rangeBody(cr, hr)
+			if err != nil {
+				log.Printf("Cache body error during GET: %v\n", err)
+				return httpError(r, fmt.Sprint(err), http.StatusInternalServerError)
+			}
+		}
+		return resp
+	}
+
+	boundary, length := multipartRangeSize(cr, ranges)
+	resp.Header.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	resp.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	if r.Method == http.MethodGet {
+		resp.Body = multipartRangeBody(cr, ranges, boundary)
+	}
+	return resp
+}
+
+// httpRange is a byte range of a body.
+type httpRange struct {
+	start, length int64
+}
+
+func (hr httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", hr.start, hr.start+hr.length-1, size)
+}
+
+func (hr httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {hr.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// errNoOverlap is returned by parseRange when no range overlaps the body.
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
+// parseRange parses a Range header value, such as "bytes=0-499,-500",
+// for a body of the given size.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errors.New("invalid range")
+	}
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = strings.TrimSpace(ra)
+		if len(ra) == 0 {
+			continue
+		}
+		first, last, ok := strings.Cut(ra, "-")
+		if !ok {
+			return nil, errors.New("invalid range")
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		var hr httpRange
+		if len(first) == 0 {
+			// Suffix range, e.g. "-500" is the last 500 bytes.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if n > size {
+				n = size
+			}
+			hr.start = size - n
+			hr.length = n
+		} else {
+			i, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if i >= size {
+				// The range begins after the end of the body.
+				noOverlap = true
+				continue
+			}
+			hr.start = i
+			if len(last) == 0 {
+				hr.length = size - i
+			} else {
+				j, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || i > j {
+					return nil, errors.New("invalid range")
+				}
+				if j >= size {
+					j = size - 1
+				}
+				hr.length = j - i + 1
+			}
+		}
+		if hr.length == 0 {
+			noOverlap = true
+			continue
+		}
+		ranges = append(ranges, hr)
+	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// rangeBody returns a reader over the given range of the record's body.
+func rangeBody(cr *CacheRecord, hr httpRange) (io.ReadCloser, error) {
+	body, err := cr.Body()
+	if err != nil {
+		return nil, err
+	}
+	// The body is compressed, so we must read our way to the start.
+	_, err = io.CopyN(io.Discard, body, hr.start)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	rc := struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(body, hr.length), body}
+	return rc, nil
+}
+
+// multipartRangeSize returns a boundary for a multipart/byteranges body
+// for the given ranges of the record's body, and the body's length.
+func multipartRangeSize(cr *CacheRecord, ranges []httpRange) (string, int64) {
+	// Calculate the length, by writing the part headers without their bodies.
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	for _, hr := range ranges {
+		mw.CreatePart(hr.mimeHeader(cr.ContentType, cr.ContentLength))
+		w += countingWriter(hr.length)
+	}
+	mw.Close()
+	return mw.Boundary(), int64(w)
+}
+
+// multipartRangeBody returns a multipart/byteranges body for the given
+// ranges of the record's body, using the given boundary.
+func multipartRangeBody(cr *CacheRecord, ranges []httpRange, boundary string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		mw := multipart.NewWriter(pw)
+		mw.SetBoundary(boundary)
+		for _, hr := range ranges {
+			part, err := mw.CreatePart(hr.mimeHeader(cr.ContentType, cr.ContentLength))
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			body, err := rangeBody(cr, hr)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(part, body)
+			body.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+	return pr
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
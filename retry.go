@@ -0,0 +1,91 @@
+package progszy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
+)
+
+// requestClient returns a client with the retry policy given by the
+// request's X-Cache-Retry-Max and X-Cache-Retry-On headers, if any.
+// The returned client shares its underlying HTTP client with base.
+func requestClient(base *retryablehttp.Client, h http.Header) (*retryablehttp.Client, error) {
+	maxValue := h.Get("X-Cache-Retry-Max")
+	onValue := h.Get("X-Cache-Retry-On")
+	if len(maxValue) == 0 && len(onValue) == 0 {
+		return base, nil
+	}
+
+	retryMax := base.RetryMax
+	if len(maxValue) > 0 {
+		n, err := strconv.Atoi(maxValue)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid X-Cache-Retry-Max value: %s", maxValue)
+		}
+		retryMax = n
+	}
+
+	checkRetry := base.CheckRetry
+	if len(onValue) > 0 {
+		codes, err := ParseStatusCodes(onValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid X-Cache-Retry-On value: %v", err)
+		}
+		checkRetry = retryOnPolicy(newStatusSet(codes...))
+	}
+
+	// We can't copy a retryablehttp.Client, it contains a sync.Once.
+	client := &retryablehttp.Client{
+		HTTPClient:   base.HTTPClient,
+		Logger:       base.Logger,
+		RetryWaitMin: base.RetryWaitMin,
+		RetryWaitMax: base.RetryWaitMax,
+		RetryMax:     retryMax,
+		CheckRetry:   checkRetry,
+		Backoff:      base.Backoff,
+		ErrorHandler: base.ErrorHandler,
+	}
+	return client, nil
+}
+
+// retryOnPolicy returns a retry policy that retries responses with
+// the given status codes, and connection errors as per the default policy.
+func retryOnPolicy(retryOn statusSet) retryablehttp.CheckRetry {
+	return func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		if err != nil || resp == nil {
+			return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+		}
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		return retryOn.has(resp.StatusCode), nil
+	}
+}
+
+// parseTimeout parses an X-Cache-Timeout value, either as a duration
+// (e.g. "30s", "1m30s"), or as a plain number of seconds.
+func parseTimeout(v string) (time.Duration, error) {
+	d, ok := parseDuration(v)
+	if !ok || d <= 0 {
+		return 0, fmt.Errorf("invalid X-Cache-Timeout value: %s", v)
+	}
+	return d, nil
+}
+
+// parseDuration parses either a duration (e.g. "30s", "1m30s"),
+// or a plain number of seconds.
+func parseDuration(v string) (time.Duration, bool) {
+	d, err := time.ParseDuration(v)
+	if err == nil {
+		return d, true
+	}
+	secs, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(secs * float64(time.Second)), true
+}
@@ -0,0 +1,35 @@
+package progszy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// parseMaxAge parses an X-Cache-Max-Age value, either as a duration
+// (e.g. "24h"), or as a plain number of seconds. Zero means that
+// every hit is revalidated.
+func parseMaxAge(v string) (time.Duration, error) {
+	d, ok := parseDuration(v)
+	if !ok || d < 0 {
+		return 0, fmt.Errorf("invalid X-Cache-Max-Age value: %s", v)
+	}
+	return d, nil
+}
+
+// isStale reports whether the given record is older than maxAge,
+// and should be revalidated with upstream. A negative maxAge means never.
+func isStale(cr *CacheRecord, maxAge time.Duration) bool {
+	return maxAge >= 0 && time.Since(cr.Created) > maxAge
+}
+
+// setConditionalHeaders makes an upstream request conditional on the
+// stored validators of the given (stale) record, if it has any.
+func setConditionalHeaders(h http.Header, cr *CacheRecord) {
+	if len(cr.ETag) > 0 {
+		h.Set("If-None-Match", cr.ETag)
+	}
+	if len(cr.LastModified) > 0 {
+		h.Set("If-Modified-Since", cr.LastModified)
+	}
+}
@@ -12,7 +12,7 @@ import (
 )
 
 // Run a server, blocking until we receive OS interrupt (ctrl-C).
-func Run(addr, cachePath string, proxy *url.URL) error {
+func Run(addr, cachePath string, proxy *url.URL, opts ...Option) error {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt)
 
@@ -40,12 +40,43 @@ func Run(addr, cachePath string, proxy *url.URL) error {
 		logger.Printf("Upstream proxy %s\n", proxy.String())
 	}
 
-	cache := NewSqliteCache(cachePath)
+	o := newOptions(opts)
+	if o.offline {
+		logger.Println("Offline mode")
+	}
+
+	binner, err := o.config.Binner()
+	if err != nil {
+		return err
+	}
+	if len(o.config.BinBy) > 0 {
+		logger.Printf("Binning by %s\n", o.config.BinBy)
+	}
+
+	cache := NewSqliteCacheWithBinner(cachePath, binner)
 	// s := NewServer(func(s *Server) { s.logger = logger })
 	h := &http.Server{
 		Addr: "127.0.0.1" + addr,
 		// Handler: http.HandlerFunc(ProxyHandlerWith(cache)),
-		Handler: ProxyHandlerWith(cache, proxy),
+		Handler: ProxyHandlerWith(cache, proxy, opts...),
+	}
+
+	// Remove expired records in the background.
+	stopSweep := make(chan struct{})
+	go sweepLoop(cache, o.config, stopSweep)
+
+	var admin *http.Server
+	if len(o.adminAddr) > 0 {
+		admin = &http.Server{
+			Addr:    "127.0.0.1" + o.adminAddr,
+			Handler: AdminHandler(cache),
+		}
+		go func() {
+			logger.Printf("Admin API listening on port %s\n", o.adminAddr[1:])
+			if err := admin.ListenAndServe(); err != http.ErrServerClosed {
+				logger.Printf("Admin API error %v\n", err)
+			}
+		}()
 	}
 
 	go func() {
@@ -67,6 +98,10 @@ func Run(addr, cachePath string, proxy *url.URL) error {
 	defer cancel()
 
 	h.Shutdown(ctx)
+	if admin != nil {
+		admin.Shutdown(ctx)
+	}
+	close(stopSweep)
 
 	err = cache.CloseAll()
 	if err != nil {
@@ -0,0 +1,137 @@
+package progszy
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+
+	"github.com/valyala/gozstd"
+)
+
+// errBodyTooLarge occurs when a body being spooled exceeds its size limit.
+var errBodyTooLarge = errors.New("progszy: body too large")
+
+// zstdWriterParams are used when compressing a spooled body.
+// The window size is capped at 8mb, bounding memory use
+// (and keeping the output decodable by browsers).
+var zstdWriterParams = gozstd.WriterParams{
+	CompressionLevel: 20,
+	WindowLog:        23,
+}
+
+// spooledBody is an HTTP body held in temporary files,
+// both as-is and Zstd compressed, so that large bodies
+// are never held in memory.
+type spooledBody struct {
+	raw  *os.File
+	zstd *os.File
+	// size is the length of the uncompressed body.
+	size int64
+	// compressedSize is the length of the compressed body.
+	compressedSize int64
+	// md5 is the hex encoded md5 sum of the uncompressed body.
+	md5 string
+}
+
+// spoolBody copies r to temporary files, compressing and hashing it as it goes.
+// If r holds more than limit bytes, errBodyTooLarge is returned.
+func spoolBody(r io.Reader, limit int64) (*spooledBody, error) {
+	raw, err := os.CreateTemp("", "progszy-*.body")
+	if err != nil {
+		return nil, err
+	}
+	zf, err := os.CreateTemp("", "progszy-*.zst")
+	if err != nil {
+		removeFile(raw)
+		return nil, err
+	}
+	b := &spooledBody{raw: raw, zstd: zf}
+
+	h := md5.New()
+	zw := gozstd.NewWriterParams(zf, &zstdWriterParams)
+	defer zw.Release()
+
+	lr := io.LimitedReader{R: r, N: limit + 1}
+	n, err := io.Copy(io.MultiWriter(raw, zw, h), &lr)
+	if err == nil && n > limit {
+		err = errBodyTooLarge
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	b.size = n
+	b.compressedSize, err = zf.Seek(0, io.SeekCurrent)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	b.md5 = hex.EncodeToString(h.Sum(nil))
+	return b, nil
+}
+
+// matchAny reports the first of the given rules that matches the body, or nil.
+func (b *spooledBody) matchAny(rules []*regexp.Regexp) *regexp.Regexp {
+	for _, re := range rules {
+		if re.MatchReader(bufio.NewReader(b.reader())) {
+			return re
+		}
+	}
+	return nil
+}
+
+// reader returns a new reader over the uncompressed body.
+func (b *spooledBody) reader() io.Reader {
+	return io.NewSectionReader(b.raw, 0, b.size)
+}
+
+// zstdReader returns a new reader over the compressed body.
+func (b *spooledBody) zstdReader() io.Reader {
+	return io.NewSectionReader(b.zstd, 0, b.compressedSize)
+}
+
+// readCloser returns a reader over the uncompressed body
+// that removes the temporary files when closed.
+func (b *spooledBody) readCloser() io.ReadCloser {
+	return &spoolReadCloser{Reader: b.reader(), b: b}
+}
+
+// Close removes the temporary files.
+func (b *spooledBody) Close() error {
+	err := removeFile(b.raw)
+	err2 := removeFile(b.zstd)
+	if err == nil {
+		err = err2
+	}
+	return err
+}
+
+type spoolReadCloser struct {
+	io.Reader
+	b *spooledBody
+}
+
+func (rc *spoolReadCloser) Close() error {
+	return rc.b.Close()
+}
+
+func removeFile(f *os.File) error {
+	if f == nil {
+		return nil
+	}
+	f.Close()
+	err := os.Remove(f.Name())
+	if os.IsNotExist(err) {
+		// Already removed.
+		return nil
+	}
+	return err
+}
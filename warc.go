@@ -0,0 +1,337 @@
+package progszy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/gozstd"
+)
+
+// See https://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/
+
+// WARC record compression, for ExportWARC.
+const (
+	WARCUncompressed = ""
+	WARCGzip         = "gzip"
+	WARCZstd         = "zstd"
+)
+
+// ExportWARC writes the records of the named bin to w, as a WARC 1.1 file:
+// a warcinfo record, followed by a response record for each cached response,
+// with its HTTP headers reconstructed from the cache record. With WARCGzip
+// or WARCZstd compression, each record is compressed individually.
+func ExportWARC(w io.Writer, cache Cache, bin, compression string) error {
+	ext := ".warc"
+	switch compression {
+	case WARCUncompressed:
+	case WARCGzip:
+		ext += ".gz"
+	case WARCZstd:
+		ext += ".zst"
+	default:
+		return fmt.Errorf("unknown WARC compression %q", compression)
+	}
+
+	infoID, err := newWARCRecordID()
+	if err != nil {
+		return err
+	}
+	info := "software: progszy\r\n" +
+		"format: WARC File Format 1.1\r\n" +
+		"conformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n"
+	err = writeWARCRecord(w, compression, []headerField{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", infoID},
+		{"WARC-Date", time.Now().UTC().Format(time.RFC3339)},
+		{"WARC-Filename", strings.TrimSuffix(bin, fileExt) + ext},
+		{"Content-Type", "application/warc-fields"},
+	}, strings.NewReader(info), int64(len(info)))
+	if err != nil {
+		return err
+	}
+
+	return cache.Walk(bin, func(cr *CacheRecord) error {
+		id, err := newWARCRecordID()
+		if err != nil {
+			return err
+		}
+		head := cr.ResponseHead()
+		body, err := cr.Body()
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		return writeWARCRecord(w, compression, []headerField{
+			{"WARC-Type", "response"},
+			{"WARC-Record-ID", id},
+			{"WARC-Date", cr.Created.UTC().Format(time.RFC3339Nano)},
+			{"WARC-Target-URI", cr.URL},
+			{"WARC-Warcinfo-ID", infoID},
+			{"Content-Type", "application/http; msgtype=response"},
+		}, io.MultiReader(strings.NewReader(head), body), int64(len(head))+cr.ContentLength)
+	})
+}
+
+// writeWARCRecord writes a WARC record with the given header fields,
+// and a block of the given length read from block.
+func writeWARCRecord(w io.Writer, compression string, fields []headerField, block io.Reader, length int64) error {
+	var cw io.WriteCloser
+	switch compression {
+	case WARCGzip:
+		cw = gzip.NewWriter(w)
+	case WARCZstd:
+		zw := gozstd.NewWriter(w)
+		defer zw.Release()
+		cw = zw
+	default:
+		cw = nopWriteCloser{w}
+	}
+
+	bw := bufio.NewWriter(cw)
+	bw.WriteString("WARC/1.1\r\n")
+	for _, f := range fields {
+		fmt.Fprintf(bw, "%s: %s\r\n", f.name, f.value)
+	}
+	fmt.Fprintf(bw, "Content-Length: %d\r\n\r\n", length)
+	n, err := io.Copy(bw, block)
+	if err != nil {
+		return err
+	}
+	if n != length {
+		return fmt.Errorf("WARC record block length %d, expected %d", n, length)
+	}
+	bw.WriteString("\r\n\r\n")
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newWARCRecordID returns a new random (version 4) UUID, as a WARC-Record-ID.
+func newWARCRecordID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// ImportWARC reads the response records of a WARC file from r, and puts
+// them in the cache, keeping their original capture time. Only responses
+// with the given status codes are imported (default is 200 only), other
+// records are skipped, as are any malformed responses. Compressed WARC
+// files (gzip or zstd, per record or whole file) are detected automatically.
+// URLs already in the cache are left unchanged. It returns the number of
+// records imported.
+//
+// Imported records are marked with their import time, which any TTL runs
+// from. They are put in the current bins, which are created after their
+// capture time, so X-Cache-As-Of only finds them as of their import.
+func ImportWARC(r io.Reader, cache Cache, cacheable ...int) (int, error) {
+	if len(cacheable) == 0 {
+		cacheable = []int{http.StatusOK}
+	}
+	statuses := newStatusSet(cacheable...)
+
+	wr, err := newWARCReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer wr.Close()
+
+	imported := time.Now()
+	n := 0
+	for {
+		h, block, err := wr.next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if h.Get("WARC-Type") != "response" || !strings.HasPrefix(h.Get("Content-Type"), "application/http") {
+			continue
+		}
+		uri := strings.Trim(h.Get("WARC-Target-URI"), "<>")
+		cr, body, err := warcCacheRecord(uri, h.Get("WARC-Date"), block, statuses)
+		if err != nil {
+			log.Printf("Skipping WARC record for %s: %v\n", uri, err)
+			continue
+		}
+		if cr == nil {
+			continue
+		}
+		cr.Imported = imported
+		err = cache.Put(cr)
+		body.Close()
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// warcCacheRecord returns a CacheRecord for the HTTP response held in the
+// block of a WARC response record, if its status is one of those given,
+// along with its body, spooled to disk, which the caller must close.
+func warcCacheRecord(uri, date string, block io.Reader, statuses statusSet) (*CacheRecord, *spooledBody, error) {
+	created, err := time.Parse(time.RFC3339Nano, date)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(block), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if !statuses.has(resp.StatusCode) {
+		return nil, nil, nil
+	}
+
+	var body io.Reader = resp.Body
+	switch enc := strings.ToLower(resp.Header.Get("Content-Encoding")); enc {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer gr.Close()
+		body = gr
+	case "deflate":
+		zr, err := zlib.NewReader(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer zr.Close()
+		body = zr
+	case "zstd":
+		zr := gozstd.NewReader(body)
+		defer zr.Release()
+		body = zr
+	default:
+		return nil, nil, fmt.Errorf("unsupported Content-Encoding %q", enc)
+	}
+	// Spool the body to disk, like an upstream response.
+	sb, err := spoolBody(body, maxBodySize)
+	if err == errBodyTooLarge {
+		return nil, nil, fmt.Errorf("body exceeds %s", byteCountDecimal(maxBodySize))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lang := resp.Header.Get("Content-Language")
+	mime := resp.Header.Get("Content-Type")
+	etag := resp.Header.Get("ETag")
+	lastMod := resp.Header.Get("Last-Modified")
+	cr, err := newCacheRecord(uri, resp.StatusCode, resp.Proto, lang, mime, etag, lastMod, 0, created)
+	if err == nil {
+		err = cr.setSpooledBody(sb)
+	}
+	if err != nil {
+		sb.Close()
+		return nil, nil, err
+	}
+	if isRedirect(cr.Status) {
+		cr.Location = resp.Header.Get("Location")
+	}
+	return cr, sb, nil
+}
+
+// warcReader reads the records of a WARC file.
+type warcReader struct {
+	br    *bufio.Reader
+	block io.Reader
+	close func()
+}
+
+// newWARCReader returns a warcReader for r, which
+// may be uncompressed, or gzip or zstd compressed.
+func newWARCReader(r io.Reader) (*warcReader, error) {
+	wr := &warcReader{close: func() {}}
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		// Multiple gzip members are read as one stream.
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		wr.close = func() { gr.Close() }
+		br = bufio.NewReader(gr)
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr := gozstd.NewReader(br)
+		wr.close = zr.Release
+		br = bufio.NewReader(zr)
+	}
+	wr.br = br
+	return wr, nil
+}
+
+// next returns the header and block of the next record,
+// skipping any unread part of the previous block.
+func (wr *warcReader) next() (textproto.MIMEHeader, io.Reader, error) {
+	if wr.block != nil {
+		_, err := io.Copy(io.Discard, wr.block)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Skip the blank lines ending the previous record.
+	var line string
+	for len(line) == 0 {
+		var err error
+		line, err = wr.br.ReadString('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil, nil, io.EOF
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+	}
+	if !strings.HasPrefix(line, "WARC/") {
+		return nil, nil, fmt.Errorf("invalid WARC record version %q", line)
+	}
+
+	h, err := textproto.NewReader(wr.br).ReadMIMEHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	length, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return nil, nil, fmt.Errorf("invalid WARC record Content-Length %q", h.Get("Content-Length"))
+	}
+	wr.block = io.LimitReader(wr.br, length)
+	return h, wr.block, nil
+}
+
+// Close releases any decompressor.
+func (wr *warcReader) Close() error {
+	wr.close()
+	return nil
+}